@@ -0,0 +1,101 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "context"
+    "reflect"
+)
+
+// A ContextCB is like a CB, but it also receives a *DecodeContext, which tells
+// it where it is in the document and lets it unmarshal nested values with the
+// same CBs.  Register it with Registry.RegisterContext().
+//
+// Example:
+//
+//     func Shape_UnmarshalJSON(ctx *jsonface.DecodeContext, bs []byte) (interface{},error) {
+//         units,_ := ctx.Value(unitsKey).(string)
+//         ...
+//     }
+type ContextCB func(ctx *DecodeContext, bs []byte) (interface{},error)
+
+// A DecodeContext describes the interface value that a ContextCB is decoding.
+// It is only valid during the call to the ContextCB; don't keep it.
+type DecodeContext struct {
+    // Type is the interface type that is being decoded.  It is nil if the
+    // ContextCB was called through a plain CB (like the ones returned by
+    // Registry.CBMap() or Registry.Lookup()), since the type isn't known then.
+    Type reflect.Type
+
+    // Registry is the Registry that started the unmarshalling.  It is nil if
+    // the unmarshalling was started with a CBMap instead of a Registry.
+    Registry *Registry
+
+    d *decodeState
+}
+
+// Path returns the location of the value in the document, as a JSON Pointer
+// (RFC 6901), like "/shapes/3".  Nested unmarshalling (like the content of
+// Variants) starts a new document, so the Path is relative to that.
+func (me *DecodeContext) Path() string { return me.d.pointer() }
+
+// Value returns the user value that is associated with 'key' in
+// Options.Values.  If there is none, the value from the context.Context
+// passed to UnmarshalContext() is returned, or nil.
+func (me *DecodeContext) Value(key interface{}) interface{} {
+    if v,has:=me.d.values[key]; has { return v }
+    if me.d.ctx!=nil { return me.d.ctx.Value(key) }
+    return nil
+}
+
+// Context returns the context.Context that was passed to UnmarshalContext(),
+// or context.Background() if the unmarshalling was started without one.  A
+// slow CB (for example, one that looks something up over the network) should
+// respect its cancellation.
+func (me *DecodeContext) Context() context.Context {
+    if me.d.ctx==nil { return context.Background() }
+    return me.d.ctx
+}
+
+// Unmarshal unmarshals a nested value with the same CBs, Options.Values, and
+// context.Context as the current unmarshalling.  If it returns a *DecodeError
+// and the ContextCB returns it unchanged, its Path is re-rooted at the
+// location of the current value, so it still points to the exact location of
+// the problem.
+func (me *DecodeContext) Unmarshal(bs []byte, destPtr interface{}) error {
+    destPtrV,e:=checkDestPtr(destPtr); if e!=nil { return e }
+    plan,e:=me.d.plans.plan(destPtrV.Type().Elem()); if e!=nil { return e }
+    return plan.unmarshal(me.d.ctx,bs,destPtrV,Options{Values:me.d.values})
+}
+
+// RegisterContext adds a ContextCB to the Registry, like Register().
+func (me *Registry) RegisterContext(name TypeName, cb ContextCB) error {
+    site:=callSite()
+    return me.update(func(s *registryState) error {
+        if s.has(name) { return &DuplicateCBError{Name:name, First:s.sites[name], Second:site} }
+        s.ctxCBs[name]=cb; s.sites[name]=site
+        return nil
+    })
+}
+
+// AddGlobalContextCB is like AddGlobalCB(), but for a ContextCB.
+func AddGlobalContextCB(name TypeName, cb ContextCB) {
+    e:=globalRegistry.RegisterContext(name,cb); if e!=nil { panic(e) }
+}
+
+// contextCB returns a plain CB for 'cb', for use outside of a Plan.  The CB
+// doesn't know where it is, so the DecodeContext has an empty Path and a nil
+// Type.
+func (me *Registry) contextCB(cb ContextCB) CB {
+    return func(bs []byte) (interface{},error) {
+        return cb(&DecodeContext{Registry:me, d:&decodeState{plans:me.planCache()}},bs)
+    }
+}
+
+// variantsContextCB returns a ContextCB for 'vs' that unmarshals nested
+// interfaces with the same CBs and Options.Values.
+func variantsContextCB(vs *Variants) ContextCB {
+    return func(ctx *DecodeContext, bs []byte) (interface{},error) { return vs.unmarshal(bs,ctx.Unmarshal) }
+}
@@ -0,0 +1,97 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "context"
+    "errors"
+    "strings"
+)
+
+func TestDecodeContext(t *testing.T) {
+    r:=NewRegistry()
+    var ctxCB ContextCB=func(ctx *DecodeContext, bs []byte) (interface{},error) {
+        if string(bs)==`"bad"` { return nil,errors.New("bad value") }
+        return IImpl(fmt.Sprintf("%v|%v|%v|%v",ctx.Path(),ctx.Type,ctx.Registry==r,ctx.Value("k"))),nil
+    }
+    e:=r.RegisterContext("jsonface.I",ctxCB); if e!=nil { panic(e) }
+    e=r.RegisterContext("jsonface.I",ctxCB); if e==nil || !strings.HasPrefix(e.Error(),"CB already defined: jsonface.I") { panic(e) }
+    e=r.Register("jsonface.I",cbs["jsonface.I"]); if e==nil { panic("expected error") }
+
+    // The DecodeContext describes the value:
+    var st struct { L []I }
+    opts:=Options{Values:map[interface{}]interface{}{ "k":"v" }}
+    e=r.UnmarshalWithOptions([]byte(`{"L":[1,2]}`),&st,opts); if fmt.Sprintf("%q %v",st.L,e)!=`["/L/0|jsonface.I|true|v" "/L/1|jsonface.I|true|v"] <nil>` { panic(fmt.Sprintf("%q %v",st.L,e)) }
+    e=r.UnmarshalWithOptions([]byte(`{"L":[1,"bad"]}`),&st,opts); if e==nil || e.(*DecodeError).Path!="/L/1" { panic(e) }
+
+    // Nested unmarshalling (here, by Variants) gets the same CBs and Values:
+    js,e:=NewVariants("Type",map[string]interface{}{ "R":RJ{} }); if e!=nil { panic(e) }
+    e=r.RegisterVariants("jsonface.J",js); if e!=nil { panic(e) }
+    var jjs []J
+    e=r.UnmarshalWithOptions([]byte(`[{"Type":"R","Sub":1}]`),&jjs,opts); if fmt.Sprintf("%v %v",jjs,e)!=`[{/Sub|jsonface.I|true|v}] <nil>` { panic(fmt.Sprintf("%v %v",jjs,e)) }
+    e=r.UnmarshalWithOptions([]byte(`[{"Type":"R","Sub":1},{"Type":"R","Sub":"bad"}]`),&jjs,opts); if e==nil || e.(*DecodeError).Path!="/1/Sub" { panic(e) }
+
+    // Children use the parent's ContextCBs, but the DecodeContext refers to the child:
+    child:=r.NewChild()
+    var i I
+    e=child.Unmarshal([]byte(`1`),&i); if fmt.Sprintf("%v %v",i,e)!=`|jsonface.I|false|<nil> <nil>` { panic(fmt.Sprintf("%v %v",i,e)) }
+    e=child.Register("jsonface.I",cbs["jsonface.I"]); if e!=nil { panic(e) }
+    e=child.Unmarshal([]byte(`1`),&i); if fmt.Sprintf("%v %v",i,e)!=`(1) <nil>` { panic(fmt.Sprintf("%v %v",i,e)) }
+
+    // Outside of a Plan, the CB doesn't know where it is:
+    cb,has:=r.Lookup("jsonface.I"); if !has { panic("Lookup failed") }
+    x,e:=cb([]byte(`1`)); if fmt.Sprintf("%v %v",x,e)!=`|<nil>|true|<nil> <nil>` { panic(fmt.Sprintf("%v %v",x,e)) }
+    e=Unmarshal([]byte(`[1]`),&st.L,r.CBMap()); if fmt.Sprintf("%v %v",st.L,e)!=`[|<nil>|true|<nil>] <nil>` { panic(fmt.Sprintf("%v %v",st.L,e)) }
+
+    // Replace() and Unregister() also apply to ContextCBs:
+    old,e:=r.Replace("jsonface.I",cbs["jsonface.I"]); if old==nil || e!=nil { panic("expected old CB") }
+    e=r.Unmarshal([]byte(`1`),&i); if fmt.Sprintf("%v %v",i,e)!=`(1) <nil>` { panic(fmt.Sprintf("%v %v",i,e)) }
+    r.Unregister("jsonface.I")
+    e=r.RegisterContext("jsonface.I",ctxCB); if e!=nil { panic(e) }
+    if r.Unregister("jsonface.I")!=nil || len(r.Names())!=1 { panic(r.Names()) }
+}
+
+type ctxKey string
+
+func TestUnmarshalContext(t *testing.T) {
+    ctx,cancel:=context.WithCancel(context.WithValue(context.Background(),ctxKey("k"),"from ctx"))
+    defer cancel()
+    r:=NewRegistry()
+    e:=r.RegisterContext("jsonface.I",func(dc *DecodeContext, bs []byte) (interface{},error) {
+        if string(bs)=="2" { cancel() }
+        return IImpl(fmt.Sprintf("%v|%v",dc.Value(ctxKey("k")),dc.Context().Err())),nil
+    }); if e!=nil { panic(e) }
+
+    // The context is available to ContextCBs, and it is checked between elements:
+    var is []I
+    e=r.UnmarshalContext(ctx,[]byte(`[1]`),&is); if fmt.Sprintf("%v %v",is,e)!=`[from ctx|<nil>] <nil>` { panic(fmt.Sprintf("%v %v",is,e)) }
+    e=r.UnmarshalContext(ctx,[]byte(`[1,2,3]`),&is)
+    if !errors.Is(e,context.Canceled) || e.(*DecodeError).Path!="" { panic(e) }
+    var m map[string]struct{ L []I }
+    e=r.UnmarshalContext(ctx,[]byte(`{"a":{"L":[]}}`),&m); if e!=context.Canceled { panic(e) }  // It is checked before starting.
+    e=UnmarshalContext(ctx,[]byte(`[1]`),&[]int{},r.CBMap()); if e!=context.Canceled { panic(e) }  // Even if no CBs are needed.
+
+    // Without a context, ContextCBs get context.Background():
+    e=r.Unmarshal([]byte(`[1]`),&is); if fmt.Sprintf("%v %v",is,e)!=`[<nil>|<nil>] <nil>` { panic(fmt.Sprintf("%v %v",is,e)) }
+
+    // Every kind of loop is checked:
+    for _,c:=range []struct{ data string; dest interface{}; path string }{
+        {`[0,2,0]`,&[3]I{},""},
+        {`{"x":2,"y":0}`,&map[string]I{},""},
+        {`{"L":[2],"K":0}`,&struct{ L []I; K I }{},""},
+        {`{"L":[2,0],"K":0}`,&struct{ L []I; K I }{},"/L"},
+    } {
+        ctx,cancel=context.WithCancel(context.Background())
+        defer cancel()
+        e=r.UnmarshalContext(ctx,[]byte(c.data),c.dest)
+        var de *DecodeError
+        if !errors.As(e,&de) || !errors.Is(e,context.Canceled) || de.Path!=c.path { panic(fmt.Sprint(c.data,e)) }
+    }
+
+    // The global version:
+    snap:=globalRegistry.Snapshot(); defer globalRegistry.Restore(snap)
+    globalRegistry.Restore(RegistrySnapshot{})
+    AddGlobalCB("jsonface.I",cbs["jsonface.I"])
+    e=GlobalUnmarshalContext(context.Background(),[]byte(`[1]`),&is); if fmt.Sprintf("%v %v",is,e)!=`[(1)] <nil>` { panic(fmt.Sprintf("%v %v",is,e)) }
+    e=GlobalUnmarshalContext(ctx,[]byte(`[1]`),&is); if e!=context.Canceled { panic(e) }
+}
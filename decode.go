@@ -0,0 +1,271 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "context"
+    "errors"
+    "io"
+    "bytes"
+    "reflect"
+    "strconv"
+    "strings"
+    "encoding"
+    "encoding/json"
+)
+
+// unmarshal is the implementation of Unmarshal.
+//
+// The data is read as a stream of tokens (with json.Decoder.Token) while we
+// walk the destination type, so the document is only parsed once.  Parts of the
+// destination that can't reach any CB are handed to encoding/json directly, and
+// the bytes of interface values are only captured when a CB needs them.
+//
+// If 'ctx' is not nil, it is checked between the elements of arrays, slices,
+// maps, and structs.
+func (me *Plan) unmarshal(ctx context.Context, bs []byte, destPtrV reflect.Value, opts Options) error {
+    if ctx!=nil { e:=ctx.Err(); if e!=nil { return e } }
+    if !me.root.hasCB { return json.Unmarshal(bs,destPtrV.Interface()) }  // No CBs are needed, so just fallback to standard behavior.
+    dec:=json.NewDecoder(bytes.NewReader(bs))
+    d:=&decodeState{collect:opts.CollectErrors, plans:me.cache, values:opts.Values, ctx:ctx}
+    if ctx!=nil { d.done=ctx.Done() }
+    e:=me.root.decode(d,dec,destPtrV.Elem()); if e!=nil { return d.collectedWith(e) }
+    if _,e=dec.Token(); e!=io.EOF {
+        if e==nil { e=errors.New("invalid data after top-level value") }
+        return d.collectedWith(d.error(me.typ,e))
+    }
+    return d.collected()
+}
+
+// decode reads the next value from 'dec' and stores it in 'v', which must be addressable.
+func (me *node) decode(d *decodeState, dec *json.Decoder, v reflect.Value) error {
+    if !me.hasCB { return d.error(me.typ,dec.Decode(v.Addr().Interface())) }
+    if me.raw {
+        var raw json.RawMessage
+        e:=dec.Decode(&raw); if e!=nil { return d.error(me.typ,e) }
+        return me.decodeRaw(d,raw,v)
+    }
+    tok,e:=dec.Token(); if e!=nil { return d.error(me.typ,e) }
+    return me.decodeToken(d,dec,tok,v)
+}
+
+// decodeRaw stores the raw JSON value 'raw' into 'v'.  It is used for interfaces
+// (which need their raw bytes for the CB) and pointers to interfaces.
+func (me *node) decodeRaw(d *decodeState, raw []byte, v reflect.Value) error {
+    switch me.typ.Kind() {
+    case reflect.Ptr:
+        if string(raw)=="null" { v.Set(reflect.Zero(me.typ)); return nil }
+        if v.IsNil() { v.Set(reflect.New(me.typ.Elem())) }
+        return me.elem.decodeRaw(d,raw,v.Elem())
+    case reflect.Interface:
+        i,e:=me.callCB(d,raw); if e!=nil { v.Set(reflect.Zero(me.typ)); return d.fail(d.cbError(me.typ,me.name,raw,e)) }
+        if tr,ok:=i.(targetResult); ok { i=tr.resolve(me.typ) }
+        if i==nil { v.Set(reflect.Zero(me.typ)); return nil }
+        iv:=reflect.ValueOf(i)
+        if !iv.Type().AssignableTo(me.typ) { v.Set(reflect.Zero(me.typ)); return d.fail(d.cbError(me.typ,me.name,raw,fmt.Errorf("cb result not assignable: %v is not assignable to %v",iv.Type(),me.typ))) }
+        v.Set(iv)
+        return nil
+    default: return d.error(me.typ,fmt.Errorf("Unexpected raw Kind: %v",me.typ.Kind()))
+    }
+}
+
+// callCB calls the CB of an interface node.
+func (me *node) callCB(d *decodeState, raw []byte) (interface{},error) {
+    if me.ctxCB==nil { return me.cb(raw) }
+    return me.ctxCB(&DecodeContext{Type:me.typ, Registry:d.plans.reg, d:d},raw)
+}
+
+// decodeToken is like decode, except that the first token of the value has
+// already been read.
+func (me *node) decodeToken(d *decodeState, dec *json.Decoder, tok json.Token, v reflect.Value) error {
+    if tok==nil {
+        // null has no effect on arrays and structs, like encoding/json.
+        switch me.typ.Kind() {
+        case reflect.Ptr,reflect.Slice,reflect.Map: v.Set(reflect.Zero(me.typ))
+        }
+        return nil
+    }
+    switch me.typ.Kind() {
+    case reflect.Ptr:
+        if v.IsNil() { v.Set(reflect.New(me.typ.Elem())) }
+        return me.elem.decodeToken(d,dec,tok,v.Elem())
+    case reflect.Array:
+        if tok!=json.Delim('[') { return d.error(me.typ,typeError(dec,tok,me.typ)) }
+        i:=0
+        for ;dec.More();i++ {
+            e:=d.checkDone(me.typ); if e!=nil { return e }
+            if i>=v.Len() { e:=skipValue(dec); if e!=nil { return d.error(me.typ,e) }; continue }
+            d.push(strconv.Itoa(i))
+            e=me.elem.decode(d,dec,v.Index(i)); if e!=nil { return e }
+            d.pop()
+        }
+        for ;i<v.Len();i++ { v.Index(i).Set(reflect.Zero(me.typ.Elem())) }
+        _,e:=dec.Token(); return d.error(me.typ,e)
+    case reflect.Slice:
+        if tok!=json.Delim('[') { return d.error(me.typ,typeError(dec,tok,me.typ)) }
+        s:=reflect.MakeSlice(me.typ,0,0)
+        for i:=0;dec.More();i++ {
+            e:=d.checkDone(me.typ); if e!=nil { return e }
+            s=reflect.Append(s,reflect.Zero(me.typ.Elem()))
+            d.push(strconv.Itoa(i))
+            e=me.elem.decode(d,dec,s.Index(i)); if e!=nil { return e }
+            d.pop()
+        }
+        v.Set(s)
+        _,e:=dec.Token(); return d.error(me.typ,e)
+    case reflect.Map:
+        if tok!=json.Delim('{') { return d.error(me.typ,typeError(dec,tok,me.typ)) }
+        if v.IsNil() { v.Set(reflect.MakeMap(me.typ)) }
+        for dec.More() {
+            e:=d.checkDone(me.typ); if e!=nil { return e }
+            keyTok,e:=dec.Token(); if e!=nil { return d.error(me.typ,e) }
+            key:=keyTok.(string)
+            d.push(key)
+            k:=reflect.New(me.typ.Key()).Elem()
+            e=me.key.decodeKey(d,key,k); if e!=nil { return e }
+            val:=reflect.New(me.typ.Elem()).Elem()
+            e=me.elem.decode(d,dec,val); if e!=nil { return e }
+            v.SetMapIndex(k,val)
+            d.pop()
+        }
+        _,e:=dec.Token(); return d.error(me.typ,e)
+    case reflect.Struct:
+        if tok!=json.Delim('{') { return d.error(me.typ,typeError(dec,tok,me.typ)) }
+        for dec.More() {
+            e:=d.checkDone(me.typ); if e!=nil { return e }
+            keyTok,e:=dec.Token(); if e!=nil { return d.error(me.typ,e) }
+            key:=keyTok.(string)
+            f:=me.field(key)
+            if f==nil { e=skipValue(dec); if e!=nil { return d.error(me.typ,e) }; continue }
+            d.push(key)
+            fv,ok:=fieldByIndex(v,f.index); if !ok { return d.error(me.typ,fmt.Errorf("cannot set embedded pointer to unexported struct: %v",me.typ)) }
+            if f.quoted { e=d.error(f.typ,decodeQuoted(dec,fv)) } else { e=f.node.decode(d,dec,fv) }
+            if e!=nil { return e }
+            d.pop()
+        }
+        _,e:=dec.Token(); return d.error(me.typ,e)
+    default: return d.error(me.typ,fmt.Errorf("Unsupported Kind: %v",me.typ.Kind()))
+    }
+}
+
+// field finds the struct field for a JSON object key.  Like encoding/json, an
+// exact match is preferred, but a case-insensitive match is also accepted.
+func (me *node) field(name string) *fieldNode {
+    if i,has:=me.byName[name]; has { return &me.fields[i] }
+    for i:=range me.fields {
+        if strings.EqualFold(me.fields[i].name,name) { return &me.fields[i] }
+    }
+    return nil
+}
+
+// decodeKey converts a JSON object key to a map key, using the same rules as encoding/json.
+func (me *node) decodeKey(d *decodeState, key string, k reflect.Value) error {
+    if me.hasCB { return me.decodeRaw(d,[]byte(key),k) }  // An interface key; the CB gets the unquoted key.
+    return d.error(me.typ,convertKey(key,k))
+}
+
+func convertKey(key string, k reflect.Value) error {
+    kt:=k.Type()
+    if reflect.PtrTo(kt).Implements(_TEXT_UNMARSHALER_TYPE) {
+        return k.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(key))
+    }
+    switch kt.Kind() {
+    case reflect.String:
+        k.SetString(key)
+    case reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64:
+        n,e:=strconv.ParseInt(key,10,64)
+        if e!=nil || k.OverflowInt(n) { return &json.UnmarshalTypeError{Value:"number "+key, Type:kt} }
+        k.SetInt(n)
+    case reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64,reflect.Uintptr:
+        n,e:=strconv.ParseUint(key,10,64)
+        if e!=nil || k.OverflowUint(n) { return &json.UnmarshalTypeError{Value:"number "+key, Type:kt} }
+        k.SetUint(n)
+    default: return fmt.Errorf("unsupported map key type: %v",kt)
+    }
+    return nil
+}
+
+// decodeQuoted handles struct fields with the ",string" option.
+func decodeQuoted(dec *json.Decoder, v reflect.Value) error {
+    tok,e:=dec.Token(); if e!=nil { return e }
+    switch T:=tok.(type) {
+    case nil:
+        if v.Kind()==reflect.Ptr { v.Set(reflect.Zero(v.Type())) }
+        return nil
+    case string:
+        return json.Unmarshal([]byte(T),v.Addr().Interface())
+    default: return typeError(dec,tok,v.Type())
+    }
+}
+
+// typeError reports a JSON value that doesn't fit the destination type.  It
+// skips the rest of the value so that the decoder stays in a sane state.
+func typeError(dec *json.Decoder, tok json.Token, t reflect.Type) error {
+    var what string
+    switch T:=tok.(type) {
+    case json.Delim:
+        if T=='{' { what="object" } else { what="array" }
+        e:=skipRest(dec,1); if e!=nil { return e }
+    case string: what="string"
+    case bool: what="bool"
+    default: what="number"
+    }
+    return &json.UnmarshalTypeError{Value:what, Type:t, Offset:dec.InputOffset()}
+}
+
+// skipValue reads and discards the next value.
+func skipValue(dec *json.Decoder) error {
+    tok,e:=dec.Token(); if e!=nil { return e }
+    if d,ok:=tok.(json.Delim); ok && (d=='{' || d=='[') { return skipRest(dec,1) }
+    return nil
+}
+
+// skipRest discards tokens until 'depth' levels of arrays/objects have been closed.
+func skipRest(dec *json.Decoder, depth int) error {
+    for depth>0 {
+        tok,e:=dec.Token(); if e!=nil { return e }
+        if d,ok:=tok.(json.Delim); ok {
+            if d=='{' || d=='[' { depth++ } else { depth-- }
+        }
+    }
+    return nil
+}
+
+// RawValue is a view of a raw JSON value that is only parsed as far as needed.
+// CBs receive the raw bytes of a value; converting them to a RawValue lets a CB
+// look at one member (like a type discriminator) without decoding the whole
+// value first:
+//
+//     typ,err := jsonface.RawValue(bs).Field("Type")
+type RawValue []byte
+
+// Field returns the raw bytes of the named member of a JSON object.  It stops
+// reading as soon as the member is found.  If the value is not an object, or
+// the member is not present, nil is returned.
+func (me RawValue) Field(name string) (RawValue,error) {
+    dec:=json.NewDecoder(bytes.NewReader(me))
+    tok,e:=dec.Token(); if e!=nil { return nil,e }
+    if tok!=json.Delim('{') { return nil,nil }
+    for dec.More() {
+        keyTok,e:=dec.Token(); if e!=nil { return nil,e }
+        if keyTok.(string)==name {
+            var raw json.RawMessage
+            e=dec.Decode(&raw); if e!=nil { return nil,e }
+            return RawValue(raw),nil
+        }
+        e=skipValue(dec); if e!=nil { return nil,e }
+    }
+    return nil,nil
+}
+
+// FieldString is like Field, but it also decodes the member as a string.  It
+// returns "" if the member is not present or is not a string.
+func (me RawValue) FieldString(name string) (string,error) {
+    raw,e:=me.Field(name); if e!=nil || raw==nil { return "",e }
+    var s string
+    if json.Unmarshal(raw,&s)!=nil { return "",nil }
+    return s,nil
+}
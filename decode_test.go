@@ -0,0 +1,59 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "errors"
+    "encoding/json"
+)
+
+type (
+    Embedded  struct { E I; Shadowed string }
+    decodeAll struct {
+        Embedded
+        *EmbeddedP
+        Tagged   I            `json:"tagged"`
+        Skipped  I            `json:"-"`
+        Quoted   int          `json:",string"`
+        Ptr      *I
+        IntKeys  map[int]I
+        Shadowed int
+        private  I
+    }
+    EmbeddedP struct { P I }
+)
+
+func TestDecodeWalk(t *testing.T) {
+    var d decodeAll
+    bs:=[]byte(`{"e":1, "P":2, "tagged":3, "Skipped":4, "Quoted":"5", "Ptr":6, "IntKeys":{"7":8}, "Shadowed":9, "private":10, "Unknown":{"a":[1,{}]}}`)
+    e:=Unmarshal(bs,&d,cbs); if e!=nil { panic(e) }
+    if fmt.Sprintf("%v %v %v %v %v %v %v %v %v",d.E,d.P,d.Tagged,d.Skipped,d.Quoted,*d.Ptr,d.IntKeys,d.Shadowed,d.private)!="(1) (2) (3) <nil> 5 (6) map[7:(8)] 9 <nil>" { panic(fmt.Sprintf("%#v",d)) }
+
+    // Pointers to interfaces are set to nil by null, without calling the CB:
+    e=Unmarshal([]byte(`{"Ptr":null}`),&d,cbs); if d.Ptr!=nil || e!=nil { panic(e) }
+
+    // null has no effect on structs and arrays:
+    ia:=[2]I{IImpl("x"),IImpl("y")}
+    e=Unmarshal([]byte(`null`),&ia,cbs); if fmt.Sprint(ia,e)!="[x y] <nil>" { panic(fmt.Sprint(ia,e)) }
+    // Missing array elements are zeroed, and extra ones are discarded:
+    e=Unmarshal([]byte(`[1]`),&ia,cbs); if fmt.Sprint(ia,e)!="[(1) <nil>] <nil>" { panic(fmt.Sprint(ia,e)) }
+    e=Unmarshal([]byte(`[1,2,[3]]`),&ia,cbs); if fmt.Sprint(ia,e)!="[(1) (2)] <nil>" { panic(fmt.Sprint(ia,e)) }
+
+    var is []I
+    e=Unmarshal([]byte(`{"a":1}`),&is,cbs); var te *json.UnmarshalTypeError; if !errors.As(e,&te) { panic(e) }
+    e=Unmarshal([]byte(`[1] [2]`),&is,cbs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal []jsonface.I at "": invalid data after top-level value` { panic(e) }
+    e=Unmarshal([]byte(`[1,`),&is,cbs); if e==nil { panic("expected syntax error") }
+
+    var nilCB struct { I I }
+    e=Unmarshal([]byte(`{"I":1}`),&nilCB,CBMap{ "jsonface.I":func(bs []byte)(interface{},error){ return nil,nil } }); if nilCB.I!=nil || e!=nil { panic(e) }
+    e=Unmarshal([]byte(`{"I":1}`),&nilCB,CBMap{ "jsonface.I":func(bs []byte)(interface{},error){ return 1,nil } }); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "/I": cb result not assignable: int is not assignable to jsonface.I` { panic(e) }
+}
+
+func TestRawValue(t *testing.T) {
+    raw:=RawValue(`{"A":[1,{"Type":"no"}],"Type":"yes","B":`)  // The data after "Type" is never read.
+    v,e:=raw.Field("Type"); if fmt.Sprintf("%s %v",v,e)!=`"yes" <nil>` { panic(fmt.Sprint(v,e)) }
+    s,e:=raw.FieldString("Type"); if fmt.Sprint(s,e)!=`yes<nil>` { panic(fmt.Sprint(s,e)) }
+    v,e=RawValue(`{"A":1}`).Field("Type"); if v!=nil || e!=nil { panic(fmt.Sprint(v,e)) }
+    v,e=RawValue(`[1]`).Field("Type"); if v!=nil || e!=nil { panic(fmt.Sprint(v,e)) }
+    s,e=RawValue(`{"Type":1}`).FieldString("Type"); if s!="" || e!=nil { panic(fmt.Sprint(s,e)) }
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "errors"
+    "io"
+    "encoding/json"
+)
+
+// A Decoder reads and decodes JSON values from an input stream, like
+// json.Decoder, but it uses a CBMap to unmarshal interfaces.  This lets you
+// decode large request bodies or streams of concatenated JSON values without
+// reading everything into memory first.
+type Decoder struct {
+    dec   *json.Decoder
+    plans *planCache
+}
+
+// NewDecoder returns a new Decoder that reads from r and uses the provided
+// CBMap to unmarshal interfaces.  The CBMap must not be modified while the
+// Decoder is in use, because the Decoder caches the Plans it computes.
+func NewDecoder(r io.Reader, cbs CBMap) *Decoder {
+    return &Decoder{dec:json.NewDecoder(r), plans:newPlanCache(cbs)}
+}
+
+// Decode reads the next JSON value from its input and stores it in the value
+// pointed to by destPtr.  Like json.Decoder, it returns io.EOF (unwrapped) when
+// there are no more values in the input, so you can loop until you see it.
+func (me *Decoder) Decode(destPtr interface{}) error {
+    destPtrV,e:=checkDestPtr(destPtr); if e!=nil { return e }
+    plan,e:=me.plans.plan(destPtrV.Type().Elem()); if e!=nil { return e }
+    start:=me.dec.InputOffset()
+    e=plan.root.decode(&decodeState{plans:me.plans},me.dec,destPtrV.Elem())
+    if errors.Is(e,io.EOF) && me.dec.InputOffset()==start { return io.EOF }  // The input ended before the value started.
+    return e
+}
+
+// DecodeAs is a typed shortcut for Decoder.Decode().  It reads the next JSON
+// value from 'd' and returns it.  (It is a function rather than a method
+// because Go methods can't have type parameters.)
+//
+// Example:
+//
+//     for dec.More() {
+//         event,err := jsonface.DecodeAs[Event](dec)
+//         ...
+//     }
+func DecodeAs[T any](d *Decoder) (T,error) {
+    var v T
+    e:=d.Decode(&v)
+    return v,e
+}
+
+// More reports whether there is another element in the current array or
+// object being parsed, or another value in the input stream.
+func (me *Decoder) More() bool { return me.dec.More() }
+
+// Token returns the next JSON token in the input stream.  It is useful for
+// walking into a large array, so that the elements can be decoded one at a
+// time with Decode().  See json.Decoder.Token for details.
+func (me *Decoder) Token() (json.Token,error) { return me.dec.Token() }
+
+// Buffered returns a reader of the data remaining in the Decoder's buffer.
+// The reader is valid until the next call to Decode.
+func (me *Decoder) Buffered() io.Reader { return me.dec.Buffered() }
+
+// InputOffset returns the input stream byte offset of the current decoder position.
+func (me *Decoder) InputOffset() int64 { return me.dec.InputOffset() }
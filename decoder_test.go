@@ -0,0 +1,68 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "io"
+    "strings"
+)
+
+func TestDecoder(t *testing.T) {
+    dec:=NewDecoder(strings.NewReader(`{"I":1} {"I":"2"}
+        [3,4] "five" [6,7,8] rest`),cbs)
+    var st struct { I I }
+    e:=dec.Decode(&st); if fmt.Sprint(st,e)!=`{(1)} <nil>` { panic(fmt.Sprint(st,e)) }
+    e=dec.Decode(&st); if fmt.Sprint(st,e)!=`{("2")} <nil>` { panic(fmt.Sprint(st,e)) }
+    var is []I
+    e=dec.Decode(&is); if fmt.Sprint(is,e)!=`[(3) (4)] <nil>` { panic(fmt.Sprint(is,e)) }
+    var s string  // Values without interfaces are decoded normally.
+    e=dec.Decode(&s); if fmt.Sprint(s,e)!=`five<nil>` { panic(fmt.Sprint(s,e)) }
+    if dec.InputOffset()!=38 { panic(dec.InputOffset()) }
+
+    // Walk into an array, and decode one element at a time:
+    tok,e:=dec.Token(); if fmt.Sprint(tok,e)!=`[ <nil>` { panic(fmt.Sprint(tok,e)) }
+    var got []string
+    for dec.More() {
+        var i I
+        e=dec.Decode(&i); if e!=nil { panic(e) }
+        got=append(got,fmt.Sprint(i))
+    }
+    tok,e=dec.Token(); if fmt.Sprint(got,tok,e)!=`[(6) (7) (8)] ] <nil>` { panic(fmt.Sprint(got,tok,e)) }
+
+    rest,e:=io.ReadAll(dec.Buffered()); if fmt.Sprintf("%q %v",rest,e)!=`" rest" <nil>` { panic(fmt.Sprint(rest,e)) }
+    e=dec.Decode(&is); if e==nil { panic("expected syntax error") }
+}
+
+func TestDecodeAs(t *testing.T) {
+    dec:=NewDecoder(strings.NewReader(`[1,2] {"I":3} 4 x`),cbs)
+    is,e:=DecodeAs[[]I](dec); if fmt.Sprintf("%v %v",is,e)!=`[(1) (2)] <nil>` { panic(fmt.Sprintf("%v %v",is,e)) }
+    st,e:=DecodeAs[struct{ I I }](dec); if fmt.Sprintf("%v %v",st,e)!=`{(3)} <nil>` { panic(fmt.Sprintf("%v %v",st,e)) }
+    i,e:=DecodeAs[I](dec); if fmt.Sprintf("%v %v",i,e)!=`(4) <nil>` { panic(fmt.Sprintf("%v %v",i,e)) }
+    _,e=DecodeAs[I](dec); if e==nil { panic("expected error") }
+}
+
+func TestDecoderEOF(t *testing.T) {
+    // The usual json.Decoder loop works, for values with and without CBs:
+    for _,c:=range []struct{ data string; newV func() interface{} }{
+        {"1 2\n",func() interface{} { return new(I) }},
+        {"1 2\n",func() interface{} { return new(int) }},
+        {`{"I":1} {"I":2} `,func() interface{} { return new(struct{ I I }) }},
+    } {
+        dec:=NewDecoder(strings.NewReader(c.data),cbs)
+        n:=0
+        for {
+            e:=dec.Decode(c.newV())
+            if e==io.EOF { break }
+            if e!=nil { panic(e) }
+            n++
+        }
+        if n!=2 { panic(n) }
+        e:=dec.Decode(c.newV()); if e!=io.EOF { panic(e) }
+    }
+
+    // If the input ends in the middle of a value, it's not a clean EOF:
+    dec:=NewDecoder(strings.NewReader(`[1,2`),cbs)
+    var is []I
+    e:=dec.Decode(&is); if e==nil || e==io.EOF { panic(e) }
+    _,e=DecodeAs[I](NewDecoder(strings.NewReader(` `),cbs)); if e!=io.EOF { panic(e) }
+}
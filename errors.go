@@ -0,0 +1,201 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "context"
+    "errors"
+    "reflect"
+    "runtime"
+    "strings"
+)
+
+// DecodeError describes a failure to unmarshal one value.  It tells you
+// exactly where the problem was, so that you can report it to whoever
+// produced the data.  Use errors.As() to get a DecodeError from the errors
+// returned by Unmarshal(), GlobalUnmarshal(), Plan.Unmarshal(), and
+// Decoder.Decode().
+type DecodeError struct {
+    Path     string        // A JSON Pointer (RFC 6901) to the value, like "/Meals/Lunch/0".  "" means the whole document.
+    Type     reflect.Type  // The Go type we were trying to unmarshal into.
+    TypeName TypeName      // The interface TypeName, if the error came from a CB.  Otherwise "".
+    Raw      []byte        // A snippet of the offending JSON data, if it is available.  It may be truncated.
+    Err      error         // The underlying error.
+}
+
+func (me *DecodeError) Error() string {
+    return fmt.Sprintf("jsonface: cannot unmarshal %v at %q: %v",me.Type,me.Path,me.Err)
+}
+
+// Unwrap returns the underlying error.
+func (me *DecodeError) Unwrap() error { return me.Err }
+
+// DecodeErrors is returned when Options.CollectErrors is enabled and one or
+// more CBs failed.  It lists every failure, in the order they occurred.  Like
+// the errors made by errors.Join(), it supports errors.Is() and errors.As().
+type DecodeErrors []*DecodeError
+
+func (me DecodeErrors) Error() string {
+    msgs:=make([]string,len(me))
+    for i,e:=range me { msgs[i]=e.Error() }
+    return strings.Join(msgs,"\n")
+}
+
+// Unwrap returns the individual DecodeErrors.
+func (me DecodeErrors) Unwrap() []error {
+    errs:=make([]error,len(me))
+    for i,e:=range me { errs[i]=e }
+    return errs
+}
+
+// DuplicateCBError is returned when you try to register a CB for a TypeName
+// that already has one.  It tells you where both registrations came from, so
+// that you can track down the conflict (for example, two plugins that both
+// register the same interface).
+type DuplicateCBError struct {
+    Name   TypeName
+    First  string  // The "file:line" of the original registration.
+    Second string  // The "file:line" of the conflicting registration.
+}
+
+func (me *DuplicateCBError) Error() string {
+    return fmt.Sprintf("CB already defined: %v (first registered at %v, registered again at %v)",me.Name,me.First,me.Second)
+}
+
+// VariantConflictError is returned when two packages try to add variants with
+// the same tag to the same interface.
+type VariantConflictError struct {
+    Name   TypeName
+    Tag    string
+    First  string  // The "file:line" of the original registration.
+    Second string  // The "file:line" of the conflicting registration.
+}
+
+func (me *VariantConflictError) Error() string {
+    return fmt.Sprintf("variant %q of %v already defined (first registered at %v, registered again at %v)",me.Tag,me.Name,me.First,me.Second)
+}
+
+// _PKG_PREFIX is the prefix of the names of all the functions in this package.
+var _PKG_PREFIX=reflect.TypeOf(Registry{}).PkgPath()+"."
+
+// _HELPER_PKG_PREFIX is the prefix of the functions in the jsonfacetest
+// package, which registers CBs on behalf of its callers.
+var _HELPER_PKG_PREFIX=reflect.TypeOf(Registry{}).PkgPath()+"/jsonfacetest."
+
+// callSite returns the "file:line" of the code that called into this package
+// (or into jsonfacetest).
+func callSite() string {
+    pcs:=make([]uintptr,32)
+    frames:=runtime.CallersFrames(pcs[:runtime.Callers(2,pcs)])
+    for {
+        f,more:=frames.Next()
+        ours:=strings.HasPrefix(f.Function,_PKG_PREFIX) || strings.HasPrefix(f.Function,_HELPER_PKG_PREFIX)
+        if !ours || strings.HasSuffix(f.File,"_test.go") { return fmt.Sprintf("%v:%v",f.File,f.Line) }
+        if !more { return "unknown" }
+    }
+}
+
+// ValidationError is returned by Registry.Validate() when the Registry doesn't
+// match the destination types.
+type ValidationError struct {
+    Unused    []TypeName  // TypeNames with a CB that never match an interface.
+    Missing   []TypeName  // Reachable interfaces that have no CB.  These are qualified TypeNames.
+    Ambiguous []TypeName  // Short TypeNames that match more than one interface.
+}
+
+func (me *ValidationError) Error() string {
+    var msgs []string
+    if len(me.Unused)>0 { msgs=append(msgs,fmt.Sprintf("unused CBs: %v",me.Unused)) }
+    if len(me.Missing)>0 { msgs=append(msgs,fmt.Sprintf("interfaces without CBs: %v",me.Missing)) }
+    if len(me.Ambiguous)>0 { msgs=append(msgs,fmt.Sprintf("ambiguous TypeNames: %v",me.Ambiguous)) }
+    return "jsonface: invalid registry: "+strings.Join(msgs,"; ")
+}
+
+// _MAX_RAW_SNIPPET is the maximum number of bytes stored in DecodeError.Raw.
+const _MAX_RAW_SNIPPET=256
+
+func snippet(raw []byte) []byte {
+    if len(raw)>_MAX_RAW_SNIPPET { raw=raw[:_MAX_RAW_SNIPPET] }
+    return append([]byte(nil),raw...)
+}
+
+// decodeState tracks our position while decoding, so that we can produce
+// useful DecodeErrors.
+type decodeState struct {
+    path    []string      // Unescaped JSON Pointer reference tokens.
+    collect bool          // Options.CollectErrors.
+    errs    DecodeErrors  // The CB failures that we have collected so far.
+    plans   *planCache    // For DecodeContext.
+    values  map[interface{}]interface{}  // Options.Values.
+    ctx     context.Context  // For UnmarshalContext(), or nil.
+    done    <-chan struct{}  // ctx.Done(), or nil.
+}
+
+func (me *decodeState) push(token string) { me.path=append(me.path,token) }
+func (me *decodeState) pop()              { me.path=me.path[:len(me.path)-1] }
+
+// checkDone returns an error if the context has been canceled.  This is a
+// hard failure, even if we are collecting errors.
+func (me *decodeState) checkDone(t reflect.Type) error {
+    select {
+    case <-me.done: return me.error(t,me.ctx.Err())
+    default: return nil
+    }
+}
+
+// pointer formats the current path as a JSON Pointer.
+func (me *decodeState) pointer() string {
+    var sb strings.Builder
+    for _,tok:=range me.path {
+        sb.WriteByte('/')
+        sb.WriteString(strings.NewReplacer("~","~0","/","~1").Replace(tok))
+    }
+    return sb.String()
+}
+
+// error wraps 'e' in a DecodeError for the current path.  DecodeErrors are
+// returned unchanged, since they already know where they came from.
+func (me *decodeState) error(t reflect.Type, e error) error {
+    if e==nil { return nil }
+    if _,ok:=e.(*DecodeError); ok { return e }
+    return &DecodeError{Path:me.pointer(), Type:t, Err:e}
+}
+
+// cbError wraps an error returned by the CB for interface 't'.  If the CB
+// failed because of a nested unmarshal (like the ones done by Variants), the
+// nested DecodeError is re-rooted at the current path so that it still points
+// to the exact location of the problem.
+func (me *decodeState) cbError(t reflect.Type, name TypeName, raw []byte, e error) error {
+    if nested,ok:=e.(*DecodeError); ok {
+        E:=*nested; E.Path=me.pointer()+nested.Path
+        return &E
+    }
+    return &DecodeError{Path:me.pointer(), Type:t, TypeName:name, Raw:snippet(raw), Err:e}
+}
+
+// fail handles a CB failure.  Normally it just returns the error, which stops
+// the decoding.  If we are collecting errors, it records the error and returns
+// nil so that we keep going.
+func (me *decodeState) fail(e error) error {
+    if !me.collect { return e }
+    me.errs=append(me.errs,e.(*DecodeError))
+    return nil
+}
+
+// collectedWith returns the error 'e' that stopped the decoding, along with
+// the CB failures that were collected before it, so that none of them are
+// lost.  'e' comes last.
+func (me *decodeState) collectedWith(e error) error {
+    if len(me.errs)==0 { return e }
+    if de,ok:=e.(*DecodeError); ok { return append(me.errs,de) }
+    return errors.Join(me.errs,e)
+}
+
+// collected returns the CB failures that were collected, or nil if there were none.
+func (me *decodeState) collected() error {
+    if len(me.errs)==0 { return nil }
+    return me.errs
+}
@@ -0,0 +1,97 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "errors"
+    "reflect"
+    "strings"
+    "encoding/json"
+)
+
+func TestDecodeError(t *testing.T) {
+    vs,e:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{} }); if e!=nil { panic(e) }
+    vcbs:=VariantsMap{ "jsonface.I":vs }.CBMap()
+
+    var meals struct { Meals map[string][]I }
+    e=Unmarshal([]byte(`{"Meals":{"Lunch":[{"Type":"A","N":1},{"Type":"B","Kid":{"Type":"Z"}}], "a/b~c":[]}}`),&meals,vcbs)
+    var de *DecodeError
+    if !errors.As(e,&de) { panic(e) }
+    if fmt.Sprintf("%v|%v|%v|%s|%v",de.Path,de.Type,de.TypeName,de.Raw,de.Err)!=`/Meals/Lunch/1/Kid|jsonface.I|jsonface.I|{"Type":"Z"}|unknown variant "Z": {"Type":"Z"}` { panic(fmt.Sprintf("%#v",de)) }
+
+    // Errors from encoding/json are wrapped too:
+    e=Unmarshal([]byte(`{"Meals":{"a/b~c":[{"Type":"A","N":"one"}]}}`),&meals,vcbs)
+    if !errors.As(e,&de) || de.Path!="/Meals/a~1b~0c/0" || de.TypeName!="jsonface.I" || !strings.Contains(de.Err.Error(),"cannot unmarshal string") { panic(e) }
+    e=Unmarshal([]byte(`{"Meals":{"Lunch":{}}}`),&meals,vcbs)
+    if !errors.As(e,&de) || de.Path!="/Meals/Lunch" || de.Type!=reflect.TypeOf([]I(nil)) || de.Raw!=nil { panic(e) }
+    e=Unmarshal([]byte(`{"Meals":{"Lunch":[`),&meals,vcbs)
+    if !errors.As(e,&de) || de.Path!="/Meals/Lunch/0" { panic(e) }
+
+    // Long values are truncated:
+    long:=`"`+strings.Repeat("x",1000)+`"`
+    e=Unmarshal([]byte(`[`+long+`]`),&[]I{},CBMap{ "jsonface.I":func([]byte)(interface{},error){ return nil,errors.New("no") } })
+    if !errors.As(e,&de) || len(de.Raw)!=_MAX_RAW_SNIPPET || de.Path!="/0" { panic(e) }
+
+    // The Decoder produces DecodeErrors too:
+    dec:=NewDecoder(strings.NewReader(`[1,{"Type":"A"},{"Type":"Q"}]`),vcbs)
+    var is []I
+    e=dec.Decode(&is); if !errors.As(e,&de) || de.Path!="/0" { panic(e) }
+}
+
+var errTestSentinel=errors.New("sentinel")
+
+func TestErrorChain(t *testing.T) {
+    sentinelCBs:=CBMap{ "jsonface.I":func(bs []byte)(interface{},error){ return nil,fmt.Errorf("wrapped: %w",errTestSentinel) } }
+    var st struct { I I }
+    e:=Unmarshal([]byte(`{"I":1}`),&st,sentinelCBs); if !errors.Is(e,errTestSentinel) || !strings.Contains(e.Error(),"wrapped: sentinel") { panic(e) }
+    var de *DecodeError
+    if !errors.As(e,&de) || de.Path!="/I" { panic(e) }
+
+    // Errors from encoding/json keep their types:
+    var se *json.SyntaxError
+    e=Unmarshal([]byte(`{"I":1,}`),&st,cbs); if !errors.As(e,&se) { panic(e) }
+    var te *json.UnmarshalTypeError
+    e=Unmarshal([]byte(`{"I":1,"S":1}`),&struct{ I I; S string }{},cbs); if !errors.As(e,&te) || !errors.As(e,&de) || de.Path!="/S" { panic(e) }
+    e=NewDecoder(strings.NewReader(`[}`),cbs).Decode(&[]I{}); if !errors.As(e,&se) { panic(e) }
+
+    // The Variants sentinels work through nested unmarshalling:
+    vs,_:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{} })
+    vm:=VariantsMap{ "jsonface.I":vs }
+    e=Unmarshal([]byte(`[{"Type":"B","Kid":{"Type":"Z"}}]`),&[]I{},vm.CBMap()); if !errors.Is(e,ErrUnknownVariant) { panic(e) }
+    e=Unmarshal([]byte(`[{"Type":"B","Kid":{}}]`),&[]I{},vm.CBMap()); if !errors.Is(e,ErrMissingDiscriminator) || errors.Is(e,ErrUnknownVariant) { panic(e) }
+    _,e=Marshal(struct{ Is []I }{[]I{IImpl("")}},vm); if !errors.Is(e,ErrUnknownVariant) || e.Error()!="struct field error: slice element error: unknown variant for type jsonface.IImpl" { panic(e) }
+}
+
+func TestCollectErrors(t *testing.T) {
+    vs,_:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{} })
+    vcbs:=VariantsMap{ "jsonface.I":vs }.CBMap()
+    data:=[]byte(`{"Items":[{"Type":"A","N":1},{"Type":"Q"},{"Type":"B"},{"N":2}],"M":{"x":{"Type":"Z"}}}`)
+    var st struct { Items []I; M map[string]I }
+
+    // Without the option, we stop at the first failure:
+    e:=Unmarshal(data,&st,vcbs); if e==nil || strings.Count(e.Error(),"jsonface:")!=1 { panic(e) }
+
+    e=UnmarshalWithOptions(data,&st,vcbs,Options{CollectErrors:true})
+    var des DecodeErrors
+    if !errors.As(e,&des) || len(des)!=3 { panic(e) }
+    if fmt.Sprintf("%v %v %v",des[0].Path,des[1].Path,des[2].Path)!="/Items/1 /Items/3 /M/x" { panic(e) }
+    if fmt.Sprintf("%v",st)!="{[{1} <nil> { <nil>} <nil>] map[x:<nil>]}" { panic(fmt.Sprintf("%v",st)) }
+    if !errors.Is(e,ErrUnknownVariant) || !errors.Is(e,ErrMissingDiscriminator) { panic(e) }
+    var de *DecodeError
+    if !errors.As(e,&de) || de!=des[0] { panic(e) }
+    if e.Error()!=errors.Join(des[0],des[1],des[2]).Error() { panic(e) }
+
+    // Syntax errors still stop everything, but the failures before them are also reported:
+    e=UnmarshalWithOptions([]byte(`[{"Type":"Q"},{]`),&[]I{},vcbs,Options{CollectErrors:true})
+    var se *json.SyntaxError
+    if !errors.As(e,&se) || !errors.As(e,&des) || len(des)!=2 || des[0].Path!="/0" || !errors.As(des[1],&se) { panic(e) }
+    e=UnmarshalWithOptions([]byte(`[{"Type":"Q"},{"Type":"A"}] x`),&[]I{},vcbs,Options{CollectErrors:true})
+    if !errors.As(e,&des) || len(des)!=2 || !errors.Is(des[0],ErrUnknownVariant) || !strings.Contains(des[1].Error(),"invalid") { panic(e) }
+    e=UnmarshalWithOptions([]byte(`{"Items":[{"Type":"Q"}],"M":1}`),&st,vcbs,Options{CollectErrors:true})  // A type mismatch.
+    var te *json.UnmarshalTypeError
+    if !errors.As(e,&des) || len(des)!=2 || des[1].Path!="/M" || !errors.As(e,&te) { panic(e) }
+    e=UnmarshalWithOptions([]byte(`[{"Type":"Q"},{]`),&[]I{},vcbs,Options{}); if errors.As(e,&des) { panic(e) }
+
+    // No failures means no error:
+    e=UnmarshalWithOptions([]byte(`[{"Type":"A"}]`),&[]I{},vcbs,Options{CollectErrors:true}); if e!=nil { panic(e) }
+}
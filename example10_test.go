@@ -0,0 +1,31 @@
+package jsonface_test
+
+// This example shows how to register a CB by type, rather than by TypeName.
+// This way, you don't need to figure out the right TypeName, and a typo can't
+// cause the CB to be silently ignored.  The compiler also makes sure that the
+// CB returns an Instrument.
+
+import (
+    "jsonface"
+
+    "fmt"
+    "encoding/json"
+)
+
+func Example_10Register() {
+    registry := jsonface.NewRegistry()
+    err := jsonface.Register(registry, func(bs []byte) (Instrument,error) {
+        var bell Bell
+        err := json.Unmarshal(bs,&bell)
+        return bell,err
+    }); if err!=nil { panic(err) }
+    fmt.Printf("Names: %v\n",registry.Names())
+
+    var gabriella BandMember
+    err = registry.Unmarshal([]byte(`{"Name":"Gabriella","Inst":{"BellPitch":"B♭"}}`),&gabriella); if err!=nil { panic(err) }
+    fmt.Printf("gabriella=%#v\n",gabriella)
+
+    // Output:
+    // Names: [jsonface_test.Instrument]
+    // gabriella=jsonface_test.BandMember{Name:"Gabriella", Inst:jsonface_test.Bell{BellPitch:"B♭"}}
+}
@@ -0,0 +1,40 @@
+package jsonface_test
+
+// This example shows how several packages can contribute implementations of
+// the same interface.  The package that defines the interface registers the
+// Variants, and then each plugin package adds its own variants from its init()
+// function.
+
+import (
+    "jsonface"
+
+    "fmt"
+)
+
+type (
+    Step   interface { Run(string) string }
+    Upper  struct {}
+    Repeat struct { Times int }
+)
+func (me Upper)  Run(s string) string { return fmt.Sprintf("UPPER(%s)",s) }
+func (me Repeat) Run(s string) string { return fmt.Sprintf("REPEAT%d(%s)",me.Times,s) }
+
+func Example_11Plugins() {
+    // These would normally be placed in the init() functions of three different
+    // packages, using RegisterVariants() and AddGlobalVariants().  I am using a
+    // Registry here so that this example doesn't conflict with other tests:
+    registry := jsonface.NewRegistry()
+    stepVariants,err := jsonface.NewVariants("Kind", map[string]interface{}{}); if err!=nil { panic(err) }
+    err = registry.RegisterVariants("jsonface_test.Step", stepVariants); if err!=nil { panic(err) }                   // The package that defines Step.
+    err = registry.AddVariants("jsonface_test.Step", map[string]interface{}{ "upper":Upper{} }); if err!=nil { panic(err) }    // Plugin 1.
+    err = registry.AddVariants("jsonface_test.Step", map[string]interface{}{ "repeat":Repeat{} }); if err!=nil { panic(err) }  // Plugin 2.
+
+    var steps []Step
+    err = registry.Unmarshal([]byte(`[{"Kind":"upper"},{"Kind":"repeat","Times":2}]`),&steps); if err!=nil { panic(err) }
+    s := "x"
+    for _,step := range steps { s = step.Run(s) }
+    fmt.Println(s)
+
+    // Output:
+    // REPEAT2(UPPER(x))
+}
@@ -0,0 +1,33 @@
+package jsonface_test
+
+// This example shows how RegisterImplementations() can replace a hand-written
+// CB like Transporter_UnmarshalJSON (from example 6).  The discriminators are
+// derived from the type names, so there is no tag-to-type switch to maintain.
+
+import (
+    "jsonface"
+
+    "fmt"
+    "reflect"
+)
+
+func Example_12Implementations() {
+    // Normally you would call jsonface.RegisterImplementations() from an init()
+    // function.  I am using a Registry here so that this example doesn't
+    // conflict with other tests:
+    registry := jsonface.NewRegistry()
+    transporterType := reflect.TypeOf((*Transporter)(nil)).Elem()
+    err := registry.RegisterImplementations(transporterType, "Type", nil, Bike{}, Bus{}, Tesla{}); if err!=nil { panic(err) }
+
+    var ts []Transporter
+    err = registry.Unmarshal([]byte(`[{ "Type":"Bike", "NumGears":9 }, { "Type":"Bus", "LineName":"7" }]`), &ts); if err!=nil { panic(err) }
+    fmt.Printf("%#v\n",ts)
+
+    // A value that doesn't implement the interface is rejected:
+    err = registry.RegisterImplementations(transporterType, "Type", nil, Bell{})
+    fmt.Println(err)
+
+    // Output:
+    // []jsonface_test.Transporter{jsonface_test.Bike{NumGears:9}, jsonface_test.Bus{LineName:"7"}}
+    // jsonface_test.Bell does not implement jsonface_test.Transporter
+}
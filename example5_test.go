@@ -5,6 +5,7 @@ import (
 
     "fmt"
     "os"
+    "encoding/json"
 )
 
 type A int64
@@ -27,3 +28,12 @@ func ExampleGetTypeName() {
     // os.Stdout: *os.File
 }
 
+func ExampleGetQualifiedTypeName() {
+    var n json.Number
+    fmt.Println("short:    ",jsonface.GetTypeName(n))
+    fmt.Println("qualified:",jsonface.GetQualifiedTypeName(n))
+
+    // Output:
+    // short:     json.Number
+    // qualified: encoding/json.Number
+}
@@ -0,0 +1,32 @@
+package jsonface_test
+
+// This example shows how RegisterVariants() can replace a hand-written CB like
+// Food_UnmarshalJSON (from example 4).  The Food types are defined in
+// example4_test.go.  Notice that nested Foods (like the ones that the Cow ate)
+// are unmarshalled automatically, without any special tricks.
+
+import (
+    "jsonface"
+
+    "fmt"
+)
+
+func Example_7Variants() {
+    // Don't use ResetGlobalCBs in normal circumstances.  We need to use it here
+    // so our tests don't conflict:
+    jsonface.ResetGlobalCBs()
+    // This would normally be placed in an init() function, but I can't do that
+    // here because it conflicts with other tests:
+    jsonface.RegisterVariants("jsonface_test.Food", "Type", map[string]interface{}{
+        "Water":Water{}, "Ice":Ice{}, "Grass":Grass{}, "Corn":Corn{}, "Cornflakes":Cornflakes{},
+        "Cow":Cow{}, "Milk":Milk{}, "Cream":Cream{}, "IceCream":IceCream{},
+    })
+
+    bs := []byte(`{"Name":"Gabriella","Meals":{"Dinner":[{"Type":"Cow","Name":"Bessie","Ate":[{"Type":"Grass","W":{"Type":"Water"}},{"Type":"Water"}]},{"Type":"Milk"}]}}`)
+    var gabriella Girl
+    err := jsonface.GlobalUnmarshal(bs,&gabriella); if err!=nil { panic(err) }
+    fmt.Printf("gabriella=%#v\n",gabriella)
+
+    // Output:
+    // gabriella=jsonface_test.Girl{Name:"Gabriella", Meals:map[jsonface_test.MealName][]jsonface_test.Food{"Dinner":[]jsonface_test.Food{jsonface_test.Cow{Name:"Bessie", Ate:[]jsonface_test.Food{jsonface_test.Grass{W:jsonface_test.Water{}}, jsonface_test.Water{}}}, jsonface_test.Milk{}}}}
+}
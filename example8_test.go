@@ -0,0 +1,35 @@
+package jsonface_test
+
+// This example shows how the Variants registered with RegisterVariants() are
+// used in both directions: GlobalMarshal() adds the discriminators, and
+// GlobalUnmarshal() uses them to choose the concrete types.  Unlike example 3,
+// the concrete types don't need their own MarshalJSON methods.
+
+import (
+    "jsonface"
+
+    "fmt"
+)
+
+func Example_8RoundTrip() {
+    // Don't use ResetGlobalCBs in normal circumstances.  We need to use it here
+    // so our tests don't conflict:
+    jsonface.ResetGlobalCBs()
+    // This would normally be placed in an init() function, but I can't do that
+    // here because it conflicts with other tests:
+    jsonface.RegisterVariants("jsonface_test.Instrument", "Type", map[string]interface{}{
+        "Bell":Bell{}, "Drum":Drum{},
+    })
+
+    band := []BandMember{ {"Gabriella",Bell{"B♭"}}, {"Rosie",Drum{14}} }
+    bs,err := jsonface.GlobalMarshal(band); if err!=nil { panic(err) }
+    fmt.Printf("Marshalled: band=%s\n",bs)
+
+    var band2 []BandMember
+    err = jsonface.GlobalUnmarshal(bs,&band2); if err!=nil { panic(err) }
+    fmt.Printf("After : band2=%#v\n",band2)
+
+    // Output:
+    // Marshalled: band=[{"Name":"Gabriella","Inst":{"Type":"Bell","BellPitch":"B♭"}},{"Name":"Rosie","Inst":{"Type":"Drum","DrumSize":14}}]
+    // After : band2=[]jsonface_test.BandMember{jsonface_test.BandMember{Name:"Gabriella", Inst:jsonface_test.Bell{BellPitch:"B♭"}}, jsonface_test.BandMember{Name:"Rosie", Inst:jsonface_test.Drum{DrumSize:14}}}
+}
@@ -0,0 +1,27 @@
+package jsonface_test
+
+// This example shows how to use a Registry instead of the global callback
+// registry.  A Registry is handy for libraries, which shouldn't modify
+// package-level state, and for tests, which can each use their own Registry
+// rather than calling ResetGlobalCBs().
+
+import (
+    "jsonface"
+
+    "fmt"
+)
+
+func Example_9Registry() {
+    registry := jsonface.NewRegistry()
+    err := registry.Register("jsonface_test.Instrument", Instrument_UnmarshalJSON); if err!=nil { panic(err) }
+    fmt.Printf("Names: %v\n",registry.Names())
+
+    bs := []byte(`{"Name":"Rosie","Inst":{"DrumSize":14}}`)
+    var rosie BandMember
+    err = registry.Unmarshal(bs,&rosie); if err!=nil { panic(err) }
+    fmt.Printf("rosie=%#v\n",rosie)
+
+    // Output:
+    // Names: [jsonface_test.Instrument]
+    // rosie=jsonface_test.BandMember{Name:"Rosie", Inst:jsonface_test.Drum{DrumSize:14}}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "reflect"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// jsonField describes one struct field, as the encoding/json package sees it.
+type jsonField struct {
+    name      string
+    index     []int         // Path through embedded structs, for reflect.Value.FieldByIndex.
+    typ       reflect.Type
+    tagged    bool          // The name came from a struct tag.
+    omitEmpty bool
+    quoted    bool          // The ",string" option applies to this field.
+}
+
+var jsonFieldsCache sync.Map  // reflect.Type --> []jsonField
+
+// jsonFields returns the fields of struct type 't' that encoding/json would
+// use, following the same rules for tags, embedded structs, and name conflicts.
+// We need to know this because we walk through structs ourselves rather than
+// letting encoding/json do it.
+func jsonFields(t reflect.Type) []jsonField {
+    if fs,has:=jsonFieldsCache.Load(t); has { return fs.([]jsonField) }
+
+    // This is a breadth-first search through the embedded structs, just like
+    // encoding/json's typeFields().
+    var fields []jsonField
+    current,next:=[]jsonField{},[]jsonField{{typ:t}}
+    count,nextCount:=map[reflect.Type]int{},map[reflect.Type]int{t:1}
+    visited:=map[reflect.Type]bool{}
+    for len(next)>0 {
+        current,next=next,nil
+        count,nextCount=nextCount,map[reflect.Type]int{}
+        for _,f:=range current {
+            if visited[f.typ] { continue }
+            visited[f.typ]=true
+            for i:=0;i<f.typ.NumField();i++ {
+                sf:=f.typ.Field(i)
+                if sf.Anonymous {
+                    t:=sf.Type; if t.Kind()==reflect.Ptr { t=t.Elem() }
+                    if sf.PkgPath!="" && t.Kind()!=reflect.Struct { continue }  // Ignore embedded fields of unexported non-struct types.
+                } else if sf.PkgPath!="" { continue }  // Ignore unexported non-embedded fields.
+                tag:=sf.Tag.Get("json"); if tag=="-" { continue }
+                name,opts:=tag,""
+                if c:=strings.Index(tag,","); c>=0 { name,opts=tag[:c],tag[c:] }
+                index:=append(append([]int(nil),f.index...),i)
+                ft:=sf.Type
+                if ft.Name()=="" && ft.Kind()==reflect.Ptr { ft=ft.Elem() }
+
+                // Record found field and index sequence.
+                if name!="" || !sf.Anonymous || ft.Kind()!=reflect.Struct {
+                    quoted:=false
+                    if strings.Contains(opts+",",",string,") {
+                        switch ft.Kind() {
+                        case reflect.Bool,reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64,reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64,reflect.Uintptr,reflect.Float32,reflect.Float64,reflect.String:
+                            quoted=true
+                        }
+                    }
+                    field:=jsonField{name:name, index:index, typ:sf.Type, tagged:name!="", omitEmpty:strings.Contains(opts+",",",omitempty,"), quoted:quoted}
+                    if field.name=="" { field.name=sf.Name }
+                    fields=append(fields,field)
+                    // If there were multiple instances, add a second, so that
+                    // the annihilation code below will see a duplicate:
+                    if count[f.typ]>1 { fields=append(fields,field) }
+                    continue
+                }
+
+                // Record new anonymous struct to explore in next round.
+                nextCount[ft]++
+                if nextCount[ft]==1 { next=append(next,jsonField{name:ft.Name(), index:index, typ:ft}) }
+            }
+        }
+    }
+
+    sort.SliceStable(fields,func(i,j int) bool {
+        fi,fj:=fields[i],fields[j]
+        if fi.name!=fj.name { return fi.name<fj.name }
+        if len(fi.index)!=len(fj.index) { return len(fi.index)<len(fj.index) }
+        if fi.tagged!=fj.tagged { return fi.tagged }
+        return indexLess(fi.index,fj.index)
+    })
+
+    // Delete all fields that are hidden by the Go rules for embedded fields,
+    // except that fields with JSON tags are promoted.
+    out:=fields[:0]
+    for advance,i:=0,0;i<len(fields);i+=advance {
+        fi:=fields[i]
+        for advance=1;i+advance<len(fields);advance++ {
+            if fields[i+advance].name!=fi.name { break }
+        }
+        if advance==1 { out=append(out,fi); continue }
+        // The fields are sorted in increasing index-length order, then by presence of tag.
+        // If the first two fields are equally dominant, then there is no dominant field.
+        if len(fields[i].index)==len(fields[i+1].index) && fields[i].tagged==fields[i+1].tagged { continue }
+        out=append(out,fi)
+    }
+    fields=out
+    sort.Slice(fields,func(i,j int) bool { return indexLess(fields[i].index,fields[j].index) })
+
+    jsonFieldsCache.Store(t,fields)
+    return fields
+}
+
+func indexLess(a,b []int) bool {
+    for k,ak:=range a {
+        if k>=len(b) { return false }
+        if ak!=b[k] { return ak<b[k] }
+    }
+    return len(a)<len(b)
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but it allocates nil
+// embedded struct pointers as it goes, like encoding/json does.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value,bool) {
+    for n,i:=range index {
+        if n>0 && v.Kind()==reflect.Ptr {
+            if v.IsNil() {
+                if !v.CanSet() { return v,false }  // Embedded pointer to an unexported struct.
+                v.Set(reflect.New(v.Type().Elem()))
+            }
+            v=v.Elem()
+        }
+        v=v.Field(i)
+    }
+    return v,true
+}
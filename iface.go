@@ -0,0 +1,38 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+// Iface wraps an interface value so that the standard encoding/json package
+// can handle it.  Sometimes you can't route the unmarshalling through jsonface
+// -- for example, when a third-party framework calls json.Unmarshal() on your
+// structs directly.  If you declare the field as an Iface, it works anyway:
+//
+//     type Drawing struct {
+//         Shapes []jsonface.Iface[Shape]
+//     }
+//
+// Iface implements json.Unmarshaler and json.Marshaler using the global
+// callback registry, like GlobalUnmarshal() and GlobalMarshal().  'T' should
+// be an interface type.  The wrapped value is in the V field.
+type Iface[T any] struct {
+    V T
+}
+
+// UnmarshalJSON unmarshals the value with GlobalUnmarshal().  A JSON null sets
+// V to its zero value.
+func (me *Iface[T]) UnmarshalJSON(bs []byte) error {
+    var v T
+    if string(bs)!="null" {
+        e:=GlobalUnmarshal(bs,&v); if e!=nil { return e }
+    }
+    me.V=v
+    return nil
+}
+
+// MarshalJSON marshals the value with GlobalMarshal(), so the discriminators
+// of any registered Variants are included.
+func (me Iface[T]) MarshalJSON() ([]byte,error) {
+    return GlobalMarshal(&me.V)  // We pass a pointer so that the static type of V (the interface) is not lost.
+}
@@ -0,0 +1,30 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "errors"
+    "encoding/json"
+)
+
+func TestIface(t *testing.T) {
+    // Don't disturb the examples, which use the global registry too:
+    snap:=globalRegistry.Snapshot(); defer globalRegistry.Restore(snap)
+    globalRegistry.Restore(RegistrySnapshot{})
+    vs,_:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{} })
+    e:=globalRegistry.RegisterVariants("jsonface.I",vs); if e!=nil { panic(e) }
+
+    // Plain encoding/json, in both directions:
+    var st struct { X Iface[I]; Xs []Iface[I]; P *Iface[I]; N Iface[I] }
+    e=json.Unmarshal([]byte(`{"X":{"Type":"A","N":1},"Xs":[{"Type":"B","Kid":{"Type":"A","N":2}},null],"P":{"Type":"A","N":3},"N":null}`),&st)
+    if fmt.Sprintf("%v %v %v %v %v",st.X.V,st.Xs,st.P.V,st.N.V,e)!="{1} [{{ {2}}} {<nil>}] {3} <nil> <nil>" { panic(fmt.Sprintf("%v %v %v %v %v",st.X.V,st.Xs,st.P.V,st.N.V,e)) }
+    bs,e:=json.Marshal(st)
+    if string(bs)!=`{"X":{"Type":"A","N":1},"Xs":[{"Type":"B","S":"","Kid":{"Type":"A","N":2}},null],"P":{"Type":"A","N":3},"N":null}` { panic(fmt.Sprint(string(bs),e)) }
+
+    // Errors are passed through:
+    e=json.Unmarshal([]byte(`{"X":{"Type":"Z"}}`),&st); if !errors.Is(e,ErrUnknownVariant) { panic(e) }
+
+    // jsonface itself also respects the Unmarshaler:
+    var x Iface[I]
+    e=Unmarshal([]byte(`{"Type":"A","N":4}`),&x,nil); if fmt.Sprint(x.V,e)!="{4} <nil>" { panic(fmt.Sprint(x.V,e)) }
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "errors"
+    "reflect"
+    "strings"
+    "unicode"
+)
+
+// ShortTypeName returns the name of a type without its package, like "Bike"
+// for main.Bike or *main.Bike.  It is the default naming function for
+// Implementations().
+func ShortTypeName(t reflect.Type) string {
+    for t.Kind()==reflect.Ptr && t.Name()=="" { t=t.Elem() }
+    return t.Name()
+}
+
+// SnakeCaseTypeName is like ShortTypeName, but it converts the name to
+// snake_case, like "city_bus" for main.CityBus or "http_server" for
+// main.HTTPServer.  You can use it as the naming function for
+// Implementations().
+func SnakeCaseTypeName(t reflect.Type) string {
+    rs:=[]rune(ShortTypeName(t))
+    var sb strings.Builder
+    for i,r:=range rs {
+        if i>0 && unicode.IsUpper(r) {
+            prev:=rs[i-1]
+            nextIsLower:=i+1<len(rs) && unicode.IsLower(rs[i+1])
+            if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) { sb.WriteByte('_') }
+        }
+        sb.WriteRune(unicode.ToLower(r))
+    }
+    return sb.String()
+}
+
+// Implementations checks that each of the 'values' implements the interface
+// 'ifaceType', and returns a map that can be used with NewVariants() (or
+// Registry.AddVariants()).  The discriminator of each value is derived from its
+// type by 'naming', which defaults to ShortTypeName if it is nil.  This saves
+// you from maintaining a tag-to-type mapping by hand.
+//
+// If a value's type doesn't implement the interface, but a pointer to it does
+// (because some methods have pointer receivers), the pointer type is used.
+//
+// Example:
+//
+//     variants,err := jsonface.Implementations(reflect.TypeOf((*Instrument)(nil)).Elem(), nil, Bell{}, Drum{}, &Piano{})
+//     // variants is map[string]interface{}{"Bell":Bell{}, "Drum":Drum{}, "Piano":&Piano{}}
+func Implementations(ifaceType reflect.Type, naming func(reflect.Type) string, values ...interface{}) (map[string]interface{},error) {
+    if ifaceType==nil { return nil,errors.New("nil type") }
+    if ifaceType.Kind()!=reflect.Interface { return nil,fmt.Errorf("not an interface type: %v",ifaceType) }
+    if naming==nil { naming=ShortTypeName }
+    variants:=make(map[string]interface{},len(values))
+    for _,x:=range values {
+        if x==nil { return nil,errors.New("nil value") }
+        t:=reflect.TypeOf(x)
+        if !t.Implements(ifaceType) {
+            if t.Kind()==reflect.Ptr || !reflect.PtrTo(t).Implements(ifaceType) { return nil,fmt.Errorf("%v does not implement %v",t,ifaceType) }
+            t=reflect.PtrTo(t); x=reflect.New(t.Elem()).Interface()
+        }
+        tag:=naming(t)
+        if tag=="" { return nil,fmt.Errorf("no discriminator for %v",t) }
+        if other,has:=variants[tag]; has { return nil,fmt.Errorf("%v and %v both use the discriminator %q",reflect.TypeOf(other),t,tag) }
+        variants[tag]=x
+    }
+    return variants,nil
+}
+
+// RegisterImplementations creates a Variants from Implementations() and adds
+// it to the Registry, like RegisterVariants().  The Variants uses the
+// InternalTag style, with 'tagKey' as the name of the discriminator member.
+// It is registered under the qualified TypeName of 'ifaceType'.
+func (me *Registry) RegisterImplementations(ifaceType reflect.Type, tagKey string, naming func(reflect.Type) string, values ...interface{}) error {
+    variants,e:=Implementations(ifaceType,naming,values...); if e!=nil { return e }
+    vs,e:=NewVariants(tagKey,variants); if e!=nil { return e }
+    return me.RegisterVariants(QualifiedTypeName(ifaceType),vs)
+}
+
+// RegisterImplementations is like RegisterVariants(), but the discriminators
+// are derived from the type names of the 'values' (see Implementations()), and
+// the tagKey is "Type".  Use Registry.RegisterImplementations() if you need
+// something different.  It panics if there is a problem.
+//
+// Example:
+//
+//     func init() {
+//         jsonface.RegisterImplementations(reflect.TypeOf((*Instrument)(nil)).Elem(), Bell{}, Drum{}, &Piano{})
+//     }
+func RegisterImplementations(ifaceType reflect.Type, values ...interface{}) {
+    e:=globalRegistry.RegisterImplementations(ifaceType,"Type",nil,values...); if e!=nil { panic(e) }
+}
@@ -0,0 +1,55 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "reflect"
+)
+
+type (
+    CityBus    struct { N int }
+    HTTPServer struct {}
+    PtrImpl    struct { X int }
+)
+func (me CityBus)    F() {}
+func (me HTTPServer) F() {}
+func (me *PtrImpl)   F() {}
+
+func TestTypeNaming(t *testing.T) {
+    for _,x:=range []struct{ x interface{}; short,snake string }{
+        {CityBus{},"CityBus","city_bus"},
+        {&HTTPServer{},"HTTPServer","http_server"},
+        {VA{},"VA","va"},
+        {IImpl(""),"IImpl","i_impl"},
+        {json2{},"json2","json2"},
+        {V2Thing{},"V2Thing","v2_thing"},
+    } {
+        t:=reflect.TypeOf(x.x)
+        if ShortTypeName(t)!=x.short || SnakeCaseTypeName(t)!=x.snake { panic(fmt.Sprint(ShortTypeName(t)," ",SnakeCaseTypeName(t))) }
+    }
+}
+
+type json2 struct {}
+type V2Thing struct {}
+
+func TestImplementations(t *testing.T) {
+    iface:=reflect.TypeOf((*I)(nil)).Elem()
+    variants,e:=Implementations(iface,nil,CityBus{},VA{},PtrImpl{})
+    if e!=nil || len(variants)!=3 || reflect.TypeOf(variants["PtrImpl"])!=reflect.TypeOf(&PtrImpl{}) || reflect.TypeOf(variants["CityBus"])!=reflect.TypeOf(CityBus{}) { panic(fmt.Sprint(variants,e)) }
+    variants,e=Implementations(iface,SnakeCaseTypeName,CityBus{},&PtrImpl{}); if e!=nil || fmt.Sprint(sortedTags(variants))!="[city_bus ptr_impl]" { panic(fmt.Sprint(variants,e)) }
+
+    _,e=Implementations(iface,nil,VA{},"str"); if fmt.Sprint(e)!="string does not implement jsonface.I" { panic(e) }
+    _,e=Implementations(iface,nil,VA{},nil); if fmt.Sprint(e)!="nil value" { panic(e) }
+    _,e=Implementations(iface,nil,VA{},struct{ VA }{}); if fmt.Sprint(e)!="no discriminator for struct { jsonface.VA }" { panic(e) }
+    _,e=Implementations(iface,func(reflect.Type) string { return "X" },VA{},VB{}); if fmt.Sprint(e)!=`jsonface.VA and jsonface.VB both use the discriminator "X"` { panic(e) }
+    _,e=Implementations(reflect.TypeOf(VA{}),nil,VA{}); if fmt.Sprint(e)!="not an interface type: jsonface.VA" { panic(e) }
+    _,e=Implementations(nil,nil,VA{}); if e==nil { panic("expected error") }
+
+    r:=NewRegistry()
+    e=r.RegisterImplementations(iface,"Kind",SnakeCaseTypeName,CityBus{},PtrImpl{},VB{}); if e!=nil { panic(e) }
+    var is []I
+    e=r.Unmarshal([]byte(`[{"Kind":"city_bus","N":1},{"Kind":"ptr_impl","X":2},{"Kind":"vb","Kid":{"Kind":"city_bus"}}]`),&is)
+    if fmt.Sprintf("%v %v %v %v",is[0],*is[1].(*PtrImpl),is[2],e)!="{1} {2} { {0}} <nil>" { panic(fmt.Sprint(is,e)) }
+    bs,e:=r.Marshal(is[:2]); if string(bs)!=`[{"Kind":"city_bus","N":1},{"Kind":"ptr_impl","X":2}]` { panic(fmt.Sprint(string(bs),e)) }
+    e=r.RegisterImplementations(iface,"Kind",nil,VA{}); if e==nil { panic("expected error") }
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package jsonfacetest helps you test code that uses the jsonface global
+// callback registry.
+//
+// Without this package, tests that register CBs conflict with each other,
+// because they all share the global registry, and the only way to undo a
+// registration is jsonface.ResetGlobalCBs(), which wipes everything.  The
+// functions in this package make temporary changes that are undone by
+// t.Cleanup when the test finishes:
+//
+//     func TestShapes(t *testing.T) {
+//         t.Parallel()
+//         jsonfacetest.OverrideGlobalCB(t, "main.Shape", fakeShapeCB)
+//         ...
+//     }
+//
+// Since the global registry can only be in one state at a time, tests that use
+// this package hold a lock until they finish.  They are safe to use with
+// t.Parallel(), but they run one at a time.  (Parallel tests that don't use
+// this package are not blocked, but they also don't get any protection.)
+// Subtests can make more changes while their parent test holds the lock, like
+// a table-driven test that calls WithRegistry() once and OverrideGlobalCB() in
+// each t.Run().  Each subtest's changes are undone when it finishes, and
+// parallel subtests still take turns.
+package jsonfacetest
+
+import (
+    "jsonface"
+
+    "strings"
+    "sync"
+    "testing"
+)
+
+// testLock gives one test at a time ownership of the global registry.  The
+// owner can re-acquire it, so a test can make several changes, and so can its
+// subtests, which are pushed onto the stack of owners.
+type testLock struct {
+    mu     sync.Mutex
+    cond   *sync.Cond
+    owners []testing.TB  // The last one is the current owner.  Each is a subtest of the one before it.
+}
+
+var lock=func() *testLock { l:=&testLock{}; l.cond=sync.NewCond(&l.mu); return l }()
+
+// acquire waits until 't' owns the lock.  It is released when 't' finishes.
+// Since cleanup functions run in last-added-first-called order, the release
+// happens after all of t's changes have been undone.
+func (me *testLock) acquire(t testing.TB) {
+    me.mu.Lock(); defer me.mu.Unlock()
+    for !me.available(t) { me.cond.Wait() }
+    if len(me.owners)>0 && me.owners[len(me.owners)-1]==t { return }
+    me.owners=append(me.owners,t)
+    t.Cleanup(func() {
+        me.mu.Lock(); me.owners=me.owners[:len(me.owners)-1]; me.mu.Unlock()
+        me.cond.Broadcast()
+    })
+}
+
+// available reports whether 't' can take the lock now:  nobody has it, 't'
+// already has it, or 't' is a subtest of the current owner.  The caller must
+// hold me.mu.
+func (me *testLock) available(t testing.TB) bool {
+    if len(me.owners)==0 { return true }
+    owner:=me.owners[len(me.owners)-1]
+    return owner==t || strings.HasPrefix(t.Name(),owner.Name()+"/")
+}
+
+// save acquires the lock and arranges for the global registry to be restored
+// to its current state when 't' finishes.
+func save(t testing.TB) *jsonface.Registry {
+    lock.acquire(t)
+    r:=jsonface.GlobalRegistry()
+    snap:=r.Snapshot()
+    t.Cleanup(func() { r.Restore(snap) })
+    return r
+}
+
+// WithRegistry replaces the whole global registry with the CBs in 'cbs' for
+// the rest of the test.  The global registry is returned, so that you can
+// register more things (like Variants) that will also be undone when the test
+// finishes.
+func WithRegistry(t testing.TB, cbs jsonface.CBMap) *jsonface.Registry {
+    t.Helper()
+    r:=save(t)
+    r.Restore(jsonface.RegistrySnapshot{})
+    for name,cb:=range cbs {
+        e:=r.Register(name,cb); if e!=nil { t.Fatal(e) }
+    }
+    return r
+}
+
+// OverrideGlobalCB sets the global CB for 'name' for the rest of the test,
+// even if one is already defined.  The other CBs in the global registry are
+// left alone.
+func OverrideGlobalCB(t testing.TB, name jsonface.TypeName, cb jsonface.CB) {
+    t.Helper()
+    r:=save(t)
+    _,e:=r.Replace(name,cb); if e!=nil { t.Fatal(e) }
+}
@@ -0,0 +1,88 @@
+package jsonfacetest
+
+import (
+    "jsonface"
+
+    "testing"
+    "fmt"
+    "errors"
+    "runtime"
+    "strings"
+)
+
+type I interface { F() }
+type S string
+func (me S) F() {}
+
+func cbFor(s string) jsonface.CB {
+    return func(bs []byte) (interface{},error) { return S(s+":"+string(bs)),nil }
+}
+
+func unmarshalI(bs string) string {
+    var i I
+    e:=jsonface.GlobalUnmarshal([]byte(bs),&i); if e!=nil { return e.Error() }
+    return fmt.Sprint(i)
+}
+
+func TestJsonfacetest(t *testing.T) {
+    e:=jsonface.TryAddGlobalCB("jsonfacetest.I",cbFor("orig")); if e!=nil { panic(e) }
+    t.Cleanup(func() { jsonface.GlobalRegistry().Unregister("jsonfacetest.I") })
+
+    t.Run("group",func(t *testing.T) {
+        for n:=0;n<10;n++ {
+            n:=n
+            t.Run(fmt.Sprint("override",n),func(t *testing.T) {
+                t.Parallel()
+                name:=fmt.Sprint("o",n)
+                OverrideGlobalCB(t,"jsonfacetest.I",cbFor(name))
+                OverrideGlobalCB(t,"jsonfacetest.I",cbFor(name+"b"))  // The same test can make several changes.
+                if got:=unmarshalI("1"); got!=name+"b:1" { panic(got) }
+            })
+            t.Run(fmt.Sprint("registry",n),func(t *testing.T) {
+                t.Parallel()
+                name:=fmt.Sprint("r",n)
+                r:=WithRegistry(t,jsonface.CBMap{ "jsonfacetest.I":cbFor(name) })
+                if fmt.Sprint(r.Names())!="[jsonfacetest.I]" { panic(r.Names()) }
+                r.Freeze()  // This is undone too.
+                if got:=unmarshalI("2"); got!=name+":2" { panic(got) }
+            })
+        }
+    })
+
+    // Everything was restored:
+    if got:=unmarshalI("3"); got!="orig:3" { panic(got) }
+    if jsonface.GlobalRegistry().Frozen() { panic("still frozen") }
+    if fmt.Sprint(jsonface.GlobalRegistry().Names())!="[jsonfacetest.I]" { panic(jsonface.GlobalRegistry().Names()) }
+}
+
+func TestWithRegistryEmpty(t *testing.T) {
+    WithRegistry(t,nil)
+    if got:=unmarshalI("1"); got!="json: cannot unmarshal number into Go value of type jsonfacetest.I" { panic(got) }
+}
+
+func TestCallSite(t *testing.T) {
+    _,file,line,_:=runtime.Caller(0); r:=WithRegistry(t,jsonface.CBMap{ "jsonfacetest.I":cbFor("x") })
+    e:=r.Register("jsonfacetest.I",cbFor("y"))
+    var dup *jsonface.DuplicateCBError
+    if !errors.As(e,&dup) || dup.First!=fmt.Sprintf("%v:%v",file,line) || !strings.HasSuffix(dup.Second,"jsonfacetest_test.go:"+fmt.Sprint(line+1)) { panic(e) }
+}
+
+func TestSubtests(t *testing.T) {
+    WithRegistry(t,jsonface.CBMap{ "jsonfacetest.I":cbFor("base") })
+    t.Run("group",func(t *testing.T) {
+        for n:=0;n<5;n++ {
+            name:=fmt.Sprint("s",n)
+            t.Run(name,func(t *testing.T) {
+                t.Parallel()
+                if got:=unmarshalI("1"); got!="base:1" { panic(got) }  // Siblings take turns, so we never see their changes.
+                OverrideGlobalCB(t,"jsonfacetest.I",cbFor(name))
+                t.Run("nested",func(t *testing.T) {
+                    OverrideGlobalCB(t,"jsonfacetest.I",cbFor(name+"n"))
+                    if got:=unmarshalI("2"); got!=name+"n:2" { panic(got) }
+                })
+                if got:=unmarshalI("3"); got!=name+":3" { panic(got) }
+            })
+        }
+    })
+    if got:=unmarshalI("4"); got!="base:4" { panic(got) }
+}
@@ -40,11 +40,11 @@ package jsonface
 import (
     "fmt"
     "os"
+    "context"
     "errors"
     "reflect"
     "encoding"
     "encoding/json"
-    "sync"
 )
 
 // 'CB' means 'Callback'.  It is used for unmarshalling, with the same interface
@@ -53,6 +53,14 @@ type CB func([]byte) (interface{},error)
 
 // TypeName is the name of a type (usually prefixed by the package name).
 // If you don't know the correct TypeName to use, try the GetTypeName() function.
+//
+// A TypeName can be either short (like "models.Event") or qualified with the
+// whole package path (like "github.com/a/models.Event").  Short names are
+// easier to type, but two different packages can have the same short name.
+// When jsonface looks for the CB of an interface, it tries the qualified name
+// first, and then the short name.  If two different interfaces would use the
+// same CB, unmarshalling fails with an error rather than silently sharing the
+// CB.
 type TypeName string
 
 // CBMap is a TypeName-->CB mapping.  It is used to tell the jsonface system which
@@ -68,30 +76,46 @@ func GetTypeName(x interface{}) TypeName {
     return TypeName(reflect.TypeOf(x).String())   // String() is more precise than Name().
 }
 
-// We want to be able to propagate CB-Generated errors directly.
-// This cbErr type allows us to detect CB-Generated errors vs our own-generated errors:
-type cbErr struct { e error }
-func (me cbErr) Error() string { return "This is a jsonface.cbErr; it should be unwrapped." }
-func fmtErr(msg string, e error) error {
-    if e==nil { return nil }
-    switch E:=e.(type) {
-    case cbErr: return E
-    default: return fmt.Errorf(msg,e)
-    }
+// GetQualifiedTypeName is like GetTypeName(), but it returns the qualified
+// TypeName, which includes the whole package path.
+func GetQualifiedTypeName(x interface{}) TypeName { return QualifiedTypeName(reflect.TypeOf(x)) }
+
+// QualifiedTypeName returns the qualified TypeName of 't', like
+// "github.com/likebike/jsonface.Registry".  Pointers are qualified too, but
+// other types without their own name (like []int) don't belong to a package,
+// so their short name is returned instead.
+func QualifiedTypeName(t reflect.Type) TypeName {
+    if t.Kind()==reflect.Ptr && t.Name()=="" { return "*"+QualifiedTypeName(t.Elem()) }
+    if t.Name()=="" || t.PkgPath()=="" { return TypeName(t.String()) }
+    return TypeName(t.PkgPath()+"."+t.Name())
 }
-func unwrapCBErr(e error) error {
+
+// lookupName finds the name that 't' is registered under in 'm'.  The
+// qualified name is preferred over the short name.
+func lookupName[V any](m map[TypeName]V, t reflect.Type) (TypeName,bool) {
+    name:=QualifiedTypeName(t)
+    if _,has:=m[name]; has { return name,true }
+    name=TypeName(t.String())
+    _,has:=m[name]
+    return name,has
+}
+
+// fmtErr adds context to an error.  'msg' should use %w for the error, so that
+// the original error is still available to errors.Is() and errors.As().
+func fmtErr(msg string, e error) error {
     if e==nil { return nil }
-    switch E:=e.(type) {
-    case cbErr: return E.e
-    default: return e
-    }
+    return fmt.Errorf(msg,e)
 }
 
-// StuntDouble is a type used internally within jsonface.  Users of jsonface
-// should ignore this type.  It is an exported symbol (capitalized) for
+// StuntDouble used to be a type used internally within jsonface.  Users of
+// jsonface should ignore this type.  It is an exported symbol (capitalized) for
 // technical reasons -- the Go json unmarshaller requires destination types to
 // be exported; an unexported symbol (lowercase) would not work.
 // I apologize for the API noise.
+//
+// Deprecated: jsonface now walks the destination type directly while reading
+// the JSON tokens, so it no longer needs StuntDoubles.  This type is only kept
+// for compatibility.
 type StuntDouble string
 func (me StuntDouble) MarshalJSON() ([]byte,error) {
     if len(me)==0 { return []byte("null"),nil }
@@ -103,45 +127,81 @@ func (me *StuntDouble) UnmarshalJSON(bs []byte) error {
     return nil
 }
 
-var _STUNT_TYPE=reflect.TypeOf(StuntDouble(""))
 var _JSON_UNMARSHALER_TYPE=reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
 var _TEXT_UNMARSHALER_TYPE=reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 
-var globalCBs=struct {
-    sync.RWMutex
-    m CBMap
-}{sync.RWMutex{},CBMap{}}
+var globalRegistry=NewRegistry()
+
+// GlobalRegistry returns the global callback registry, which is used by
+// AddGlobalCB(), GlobalUnmarshal(), and friends.  You can use it to inspect
+// the global registry, or to combine it with your own Registries.
+func GlobalRegistry() *Registry { return globalRegistry }
 
 // AddGlobalCB adds an entry to the global callback registry.
 // Then, when GlobalUnmarshal() is called, this global registry will be used to
 // perform the unmarshalling.  You will normally call AddGlobalCB() during
 // program initialization (from an init() function) to register your
 // unmarshallable interfaces.
+//
+// AddGlobalCB panics if a CB is already defined for 'name', or if the global
+// registry has been frozen with GlobalRegistry().Freeze().
 func AddGlobalCB(name TypeName, cb CB) {
-    globalCBs.Lock(); defer globalCBs.Unlock()
-    if _,has:=globalCBs.m[name]; has { panic(errors.New("CB already defined")) }
-    globalCBs.m[name]=cb
+    e:=globalRegistry.Register(name,cb); if e!=nil { panic(e) }
 }
 
+// TryAddGlobalCB is like AddGlobalCB(), but it returns an error instead of
+// panicking.  If a CB is already defined for 'name', the error is a
+// *DuplicateCBError.  This is useful for code that loads plugins, which might
+// want to handle duplicates gracefully.
+func TryAddGlobalCB(name TypeName, cb CB) error { return globalRegistry.Register(name,cb) }
+
 // ResetGlobalCBs removes all definitions from the global callback registry.
 // You probably shouldn't use this -- I just need to use it from my unit tests
 // because Go runs all tests consecutively without resetting the namespace, and
 // so my tests conflict with eachother.  I need to use this to reset the
 // registry between tests.
 //
-// If you think you need this, instead consider using Unmarshal() and passing
-// in your own CBMap.
+// If you think you need this, instead consider using your own Registry, or
+// using Unmarshal() and passing in your own CBMap.  In your own tests, the
+// jsonfacetest package can make temporary changes to the global registry,
+// which are undone when each test finishes.
 func ResetGlobalCBs() {
     fmt.Fprintln(os.Stderr, "Warning: You are calling ResetGlobalCBs.  This should probably only be used from the jsonface unit tests!")
-    globalCBs.Lock(); defer globalCBs.Unlock()
-    for k:=range globalCBs.m { delete(globalCBs.m,k) }
+    globalRegistry.reset()
 }
 
 // GlobalUnmarshal uses the global callback registry (created by the
 // AddGlobalCB() funcion) to unmarshal data.
-func GlobalUnmarshal(bs []byte, destPtr interface{}) error {
-    globalCBs.RLock(); defer globalCBs.RUnlock()
-    return Unmarshal(bs,destPtr,globalCBs.m)
+//
+// The Plans computed for each destination type are cached, so repeated calls
+// with the same type are cheap.  The cache is discarded whenever the registry
+// changes.  GlobalUnmarshal doesn't hold any locks while it works, so you can
+// call it from many goroutines at once, and your CBs can call it recursively.
+func GlobalUnmarshal(bs []byte, destPtr interface{}) error { return globalRegistry.Unmarshal(bs,destPtr) }
+
+// GlobalUnmarshalContext is like GlobalUnmarshal(), but it stops early if
+// 'ctx' is canceled.  See UnmarshalContext().
+func GlobalUnmarshalContext(ctx context.Context, bs []byte, destPtr interface{}) error {
+    return globalRegistry.UnmarshalContext(ctx,bs,destPtr)
+}
+
+// GlobalUnmarshalWith is like GlobalUnmarshal(), but the CBs in 'overlay' take
+// precedence over the global callback registry for this one call.  See
+// Registry.UnmarshalWith() for details.
+//
+// Example:  err := jsonface.GlobalUnmarshalWith(bs, &x, jsonface.CBMap{"main.Shape": tenantShapeCB})
+func GlobalUnmarshalWith(bs []byte, destPtr interface{}, overlay CBMap) error {
+    return globalRegistry.UnmarshalWith(bs,destPtr,overlay)
+}
+
+// GlobalMarshal is like Marshal(), but it uses the Variants from the global
+// callback registry (added by the RegisterVariants() function).
+func GlobalMarshal(v interface{}) ([]byte,error) { return globalRegistry.Marshal(v) }
+
+// GlobalMarshalIndent is like MarshalIndent(), but it uses the Variants from
+// the global callback registry.
+func GlobalMarshalIndent(v interface{}, prefix, indent string) ([]byte,error) {
+    return globalRegistry.MarshalIndent(v,prefix,indent)
 }
 
 // Unmarshal uses the provided CBMap to perform unmarshalling.  It does not use
@@ -151,185 +211,73 @@ func GlobalUnmarshal(bs []byte, destPtr interface{}) error {
 //
 // Some "advanced situations" where you might want to use Unmarshal() are:
 //
-//     * You want to unmarshal many objects in parallel.  (GlobalUnmarshal
-//       uses a lock, and therefore only processes items in series.)
-//
 //     * You only want the callback registration to be temporary.
 //
 //     * You are creating and *destroying* types dynamically.
 //
 //     * You need to avoid name collisions.  (Not usually a problem.)
+//
+// A Registry is often a better fit for these situations, since it lets you
+// manage a set of CBs without passing a CBMap around.
+//
+// If you call Unmarshal() many times with the same destination type, consider
+// using Compile() instead, which avoids repeating the type analysis.
 func Unmarshal(bs []byte, destPtr interface{}, cbs CBMap) error {
-    destPtrV:=reflect.ValueOf(destPtr)
-    if !destPtrV.IsValid() { return errors.New("invalid destPtr") }
-    if destPtrV.Kind()!=reflect.Ptr { return errors.New("destPtr is not a pointer") }
-    if destPtrV.IsNil() { return errors.New("nil destPtr") }
-    destType:=destPtrV.Elem().Type(); if destType==nil { return errors.New("nil destType") }
-    sdType,hasStunt,e:=stuntdoubleType(destType,cbs); if e!=nil { return fmt.Errorf("stuntdoubleType error: %v",e) }
-    if !hasStunt { return json.Unmarshal(bs,destPtr) }  // If no stunt was used, just fallback to standard behavior.
-    sdPtrV:=reflect.New(sdType)
-    if !sdPtrV.CanInterface() { return errors.New("cannot sdPtrV.Interface()") }
-    e=json.Unmarshal(bs,sdPtrV.Interface()); if e!=nil { return fmt.Errorf("json.Unmarshal error: %v",e) }
-    e=stuntdoubleToReal(sdPtrV,destPtrV,cbs); if e!=nil { return unwrapCBErr(fmtErr("stuntdoubleToReal error: %v",e)) }
-    return nil
+    return UnmarshalWithOptions(bs,destPtr,cbs,Options{})
 }
 
-// stuntdoubleType transforms the given 'realType' to a StuntDouble type.
-// Primitive types (like int) and types that do not have an entry in the CBMap
-// do not need transformation, and are returned directly.
-func stuntdoubleType(realType reflect.Type, cbs CBMap) (reflect.Type,bool,error) {
-    if realType==nil { return nil,false,errors.New("nil realType!  If you are trying to get the type of an interface, you must use some indirection because Go discards the types of interface values at compile time.  See https://golang.org/pkg/reflect/#TypeOf .  Example: var x MyInterface; stuntdoubleType(reflect.ValueOf(&x).Elem().Type(), cbs)") }
-
-    // Check realType and its pointer type for Unmarshaler:
-    realPtrType:=reflect.PtrTo(realType)
-    if realType.Implements(_JSON_UNMARSHALER_TYPE) || realPtrType.Implements(_JSON_UNMARSHALER_TYPE) ||
-       realType.Implements(_TEXT_UNMARSHALER_TYPE) || realPtrType.Implements(_TEXT_UNMARSHALER_TYPE) { return realType,false,nil }  // Don't descend into this type to avoid losing the custom unmarshaling behavior which probably sets unexported fields that we wouldn't be able to access.
-
-    switch realType.Kind() {
-    case reflect.Invalid:
-        return nil,false,errors.New("invalid kind")
-    case reflect.Bool,reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64,reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64,reflect.Uintptr,reflect.Float32,reflect.Float64,reflect.Complex64,reflect.Complex128,reflect.Func,reflect.String,reflect.UnsafePointer:
-        return realType,false,nil
-    case reflect.Ptr:
-        sdElType,hasStunt,e:=stuntdoubleType(realType.Elem(),cbs); if e!=nil { return nil,false,fmt.Errorf("stuntdoubleType(ptr elem) error: %v",e) }
-        if !hasStunt { return realType,hasStunt,nil }
-        return reflect.PtrTo(sdElType),hasStunt,nil
-    case reflect.Interface:
-        _,has:=cbs[TypeName(realType.String())]; if !has { return realType,false,nil }
-        return _STUNT_TYPE,true,nil
-    case reflect.Array:
-        sdElType,hasStunt,e:=stuntdoubleType(realType.Elem(),cbs); if e!=nil { return nil,false,fmt.Errorf("stuntdoubleType(array elem) error: %v",e) }
-        if !hasStunt { return realType,hasStunt,nil }
-        return reflect.ArrayOf(realType.Len(),sdElType),hasStunt,nil
-    case reflect.Slice:
-        sdElType,hasStunt,e:=stuntdoubleType(realType.Elem(),cbs); if e!=nil { return nil,false,fmt.Errorf("stuntdoubleType(slice elem) error: %v",e) }
-        if !hasStunt { return realType,hasStunt,nil }
-        return reflect.SliceOf(sdElType),hasStunt,nil
-    case reflect.Struct:
-        // There are some pretty severe limitations of runtime struct type generation.
-        // In particular, you can't creates structs with unexported fields.
-        // Fortunately, this is usually OK for our use case.
-        // I don't try to overcome these limitations -- I just allow StructOf() to panic.
-        var sdFields []reflect.StructField; hasStunt:=false
-        for i:=0;i<realType.NumField();i++ {
-            sdField:=realType.Field(i)
-            sdFieldType,hasD,e:=stuntdoubleType(sdField.Type,cbs); if e!=nil { return nil,false,fmt.Errorf("stuntdoubleType(struct field) error: %v : %v",sdField.Name,e) }
-            hasStunt=hasStunt||hasD
-            sdField.Type=sdFieldType
-            sdFields=append(sdFields,sdField)
-        }
-        if !hasStunt { return realType,hasStunt,nil }
-        return reflect.StructOf(sdFields),hasStunt,nil
-    case reflect.Map:
-        sdKeyType,hasDK,e:=stuntdoubleType(realType.Key(),cbs); if e!=nil { return nil,false,fmt.Errorf("stuntdoubleType(map key) error: %v",e) }
-        sdElType,hasDE,e:=stuntdoubleType(realType.Elem(),cbs); if e!=nil { return nil,false,fmt.Errorf("stuntdoubleType(slice elem) error: %v",e) }
-        if !(hasDK || hasDE) { return realType,false,nil }
-        return reflect.MapOf(sdKeyType,sdElType),true,nil
-    case reflect.Chan: return nil,false,fmt.Errorf("Chan unmarshal not yet implemented")  // If I implement this, it could open up some interesting design possibilities...
-    default: return nil,false,fmt.Errorf("Unsupported Kind: %v",realType.Kind())
-    }
+// UnmarshalAs is a typed shortcut for Registry.Unmarshal().  It returns the
+// unmarshalled value instead of filling a destination pointer, so you can't
+// accidentally pass a non-pointer.  If 'r' is nil, the global callback
+// registry is used.
+//
+// Example:  band,err := jsonface.UnmarshalAs[[]BandMember](bs, nil)
+func UnmarshalAs[T any](bs []byte, r *Registry) (T,error) {
+    if r==nil { r=globalRegistry }
+    var v T
+    e:=r.Unmarshal(bs,&v)
+    return v,e
 }
 
-// stuntdoubleToReal is the inverse of 'stuntdoubleType'.  It transforms a type
-// containing StuntDoubles into a real type.  It uses the callbacks in CBMap to
-// accomplish this.
-func stuntdoubleToReal(sd,real reflect.Value, cbs CBMap) error {
-    sdType:=sd.Type(); realType:=real.Type()
-
-    if sdType==_STUNT_TYPE {
-        if cb,has:=cbs[TypeName(realType.String())]; has {
-            i,e:=cb([]byte(sd.Interface().(StuntDouble))); if e!=nil { return cbErr{e} }
-            sd=reflect.ValueOf(i); sdType=sd.Type()
-        }
-    }
-
-    // Unmarshalers are always implemented on pointer receivers:
-    sdPtrType:=reflect.PtrTo(sdType)
-    if sdPtrType.Implements(_JSON_UNMARSHALER_TYPE) || sdPtrType.Implements(_TEXT_UNMARSHALER_TYPE) {
-        // Don't descend into this type to avoid losing the custom unmarshaling behavior which probably sets unexported fields that we wouldn't be able to access.
-        if !real.CanSet() { return errors.New("cannot set 01") }
-        if !sdType.AssignableTo(realType) { return fmt.Errorf("cb result not assignable") }
-        real.Set(sd)
-        return nil
-    }
+// Options adjusts the behavior of UnmarshalWithOptions().  The zero value
+// gives the same behavior as Unmarshal().
+type Options struct {
+    // CollectErrors makes unmarshalling continue after a CB fails.  The
+    // interface that the CB was filling is left as nil, and all the failures
+    // are returned together as DecodeErrors after the rest of the data has
+    // been processed.  This is useful for validating large documents (like
+    // user-uploaded configuration), where you want to report every problem
+    // at once.  Malformed JSON still stops unmarshalling immediately, since
+    // there is no sensible way to continue; the error that stopped it is then
+    // returned last, after the CB failures that were collected before it.
+    CollectErrors bool
 
-    switch real.Kind() {
-    case reflect.Invalid:
-        return errors.New("invalid kind")
-    case reflect.Bool,reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64,reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64,reflect.Uintptr,reflect.Float32,reflect.Float64,reflect.Complex64,reflect.Complex128,reflect.Func,reflect.String,reflect.UnsafePointer:
-        if !real.CanSet() { return errors.New("cannot set 02") }
-        if !sdType.AssignableTo(realType) { return fmt.Errorf("cb result not assignable") }
-        real.Set(sd)
-        return nil
-    case reflect.Ptr:
-        if sd.Kind()!=reflect.Ptr { return errors.New("Incompatible stuntdouble and real kinds") }
-        if sd.IsNil() {
-            if real.IsNil() { return nil }
-            if !real.CanSet() { return errors.New("cannot set 03") }
-            real.Set(sd)
-            return nil
-        }
-        if real.IsNil() {
-            if !real.CanSet() { return errors.New("cannot set 04") }
-            real.Set(reflect.New(real.Type().Elem()))
-        }
-        return stuntdoubleToReal(sd.Elem(),real.Elem(),cbs)
-    case reflect.Interface:
-        if !real.CanSet() { return errors.New("cannot set 05") }
-        if !sdType.AssignableTo(realType) { return fmt.Errorf("cb result not assignable") }
-        real.Set(sd)
-        return nil
-    case reflect.Array:
-        if sd.Kind()!=reflect.Array && sd.Kind()!=reflect.Slice { return errors.New("Incompatible stuntdouble and real kinds") }
-        rlen:=real.Len()
-        if sd.Len()!=rlen { return errors.New("unequal array lengths") }
-        for i:=0;i<rlen;i++ {
-            e:=stuntdoubleToReal(sd.Index(i),real.Index(i),cbs); if e!=nil { return fmtErr("array element stuntdoubleToReal error: %v",e) }
-        }
-        return nil
-    case reflect.Slice:
-        if sd.Kind()!=reflect.Array && sd.Kind()!=reflect.Slice { return errors.New("Incompatible stuntdouble and real kinds") }
-        dlen:=sd.Len()
-        s:=reflect.MakeSlice(realType,dlen,dlen)
-        for i:=0;i<dlen;i++ {
-            e:=stuntdoubleToReal(sd.Index(i),s.Index(i),cbs); if e!=nil { return fmtErr("slice element stuntdoubleToReal error: %v",e) }
-        }
-        if !real.CanSet() { return errors.New("cannot set 06") }
-        real.Set(s)
-        return nil
-    case reflect.Struct:
-        if sd.Kind()!=reflect.Struct { return errors.New("Incompatible stuntdouble and real kinds") }
-        rnf:=realType.NumField()
-        if sdType.NumField()!=rnf { return errors.New("unequal struct NumFields") }
-        for i:=0;i<rnf;i++ {
-            rf:=realType.Field(i); df:=sdType.Field(i)
-            if rf.Name!=df.Name { return errors.New("unequal struct field names") }
-            e:=stuntdoubleToReal(sd.Field(i),real.Field(i),cbs); if e!=nil { return fmtErr("struct field stuntdoubleToReal error: %v",e) }
-        }
-        return nil
-    case reflect.Map:
-        if sd.Kind()!=reflect.Map { return errors.New("Incompatible stuntdouble and real kinds") }
-        rkeyType:=realType.Key(); rvalType:=realType.Elem()
-        m:=reflect.MakeMapWithSize(realType,sd.Len())
-
-        // More efficient way to do it in Go 1.12:
-        // iter:=sd.MapRange()
-        // for iter.Next() {
-        //     dk:=iter.Key(); dv:=iter.Value()
+    // Values are made available to ContextCBs with DecodeContext.Value().
+    // This lets you pass request-scoped information (like the current user,
+    // or the units of measurement) to your CBs.
+    Values map[interface{}]interface{}
+}
 
-        keys:=sd.MapKeys()
-        for _,dk:=range keys {
-            dv:=sd.MapIndex(dk)
-            rk:=reflect.New(rkeyType).Elem(); rv:=reflect.New(rvalType).Elem()
-            e:=stuntdoubleToReal(dk,rk,cbs); if e!=nil { return fmtErr("map key stuntdoubleToReal error: %v",e) }
-            e=stuntdoubleToReal(dv,rv,cbs);  if e!=nil { return fmtErr("map val stuntdoubleToReal error: %v",e) }
-            m.SetMapIndex(rk,rv)
-        }
-        if !real.CanSet() { return errors.New("cannot set 07") }
-        real.Set(m)
-        return nil
-    case reflect.Chan: return fmt.Errorf("Chan unmarshal not yet implemented")  // If I implement this, it could open up some interesting design possibilities...
-    default: return fmt.Errorf("Unsupported Kind: %v",real.Kind())
-    }
+// UnmarshalWithOptions is like Unmarshal(), but it lets you adjust the
+// behavior with Options.
+func UnmarshalWithOptions(bs []byte, destPtr interface{}, cbs CBMap, opts Options) error {
+    destPtrV,e:=checkDestPtr(destPtr); if e!=nil { return e }
+    plan,e:=newPlanCache(cbs).plan(destPtrV.Type().Elem()); if e!=nil { return e }
+    return plan.unmarshal(nil,bs,destPtrV,opts)
 }
 
+// UnmarshalContext is like Unmarshal(), but it stops early if 'ctx' is
+// canceled.  This is useful for large request bodies:  when the client goes
+// away, there is no point in finishing.  The context is checked between the
+// elements of arrays, slices, maps, and structs, and the error is ctx.Err()
+// (wrapped in a *DecodeError that says where we stopped, so use errors.Is()
+// to check for it).  Parts of the data that can't reach any CB are handed to
+// encoding/json as a whole, so they can't be interrupted.
+//
+// The context is also available to ContextCBs, with DecodeContext.Context()
+// and DecodeContext.Value().
+func UnmarshalContext(ctx context.Context, bs []byte, destPtr interface{}, cbs CBMap) error {
+    destPtrV,e:=checkDestPtr(destPtr); if e!=nil { return e }
+    plan,e:=newPlanCache(cbs).plan(destPtrV.Type().Elem()); if e!=nil { return e }
+    return plan.unmarshal(ctx,bs,destPtrV,Options{})
+}
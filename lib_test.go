@@ -5,6 +5,9 @@ import (
     "fmt"
     "strings"
     "reflect"
+    "errors"
+    "image/color"
+    "encoding/json"
 )
 
 type I interface { F() }
@@ -15,63 +18,69 @@ func (me IImpl) F() {}
 
 var cbs=CBMap{ "jsonface.I":func(bs []byte)(interface{},error){ return `(`+IImpl(bs)+`)`,nil } }
 
-func TestStuntDouble(t *testing.T) {
-    d,h,e:=stuntdoubleType(reflect.TypeOf(int32(0)),cbs); if fmt.Sprint(d,h,e)!="int32 false <nil>" { panic(fmt.Sprint(d,h,e)) }
+// hasCB reports whether the Plan for 't' needs any CBs.
+func hasCB(t reflect.Type, cbs CBMap) (bool,error) {
+    plan,e:=newPlanCache(cbs).plan(t); if e!=nil { return false,e }
+    return plan.root.hasCB,nil
+}
+
+func TestPlanHasCB(t *testing.T) {
+    h,e:=hasCB(reflect.TypeOf(int32(0)),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var i I
-    d,h,e=stuntdoubleType(reflect.TypeOf(i),cbs); if e==nil || !strings.Contains(e.Error(),"nil realType") { panic(e) }
-    d,h,e=stuntdoubleType(reflect.ValueOf(&i).Elem().Type(),cbs); if fmt.Sprint(d,h,e)!="jsonface.StuntDouble true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(i),cbs); if e==nil || !strings.Contains(e.Error(),"nil type") { panic(e) }
+    h,e=hasCB(reflect.ValueOf(&i).Elem().Type(),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var j J
-    d,h,e=stuntdoubleType(reflect.ValueOf(&j).Elem().Type(),cbs); if fmt.Sprint(d,h,e)!="jsonface.J false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.ValueOf(&j).Elem().Type(),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var is []I
-    d,h,e=stuntdoubleType(reflect.TypeOf(is),cbs); if fmt.Sprint(d,h,e)!="[]jsonface.StuntDouble true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(is),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var js []J
-    d,h,e=stuntdoubleType(reflect.TypeOf(js),cbs); if fmt.Sprint(d,h,e)!="[]jsonface.J false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(js),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var ia [10]I
-    d,h,e=stuntdoubleType(reflect.TypeOf(ia),cbs); if fmt.Sprint(d,h,e)!="[10]jsonface.StuntDouble true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(ia),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var ja [10]J
-    d,h,e=stuntdoubleType(reflect.TypeOf(ja),cbs); if fmt.Sprint(d,h,e)!="[10]jsonface.J false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(ja),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var it struct { I I; S string; F float64; B []byte }
-    d,h,e=stuntdoubleType(reflect.TypeOf(it),cbs); if fmt.Sprint(d,h,e)!="struct { I jsonface.StuntDouble; S string; F float64; B []uint8 } true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(it),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var jt struct { J J; S string; F float64; B []byte }
-    d,h,e=stuntdoubleType(reflect.TypeOf(jt),cbs); if fmt.Sprint(d,h,e)!="struct { J jsonface.J; S string; F float64; B []uint8 } false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(jt),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var its []struct { I I; S string; F float64; B []byte }
-    d,h,e=stuntdoubleType(reflect.TypeOf(its),cbs); if fmt.Sprint(d,h,e)!="[]struct { I jsonface.StuntDouble; S string; F float64; B []uint8 } true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(its),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var jts []struct { J J; S string; F float64; B []byte }
-    d,h,e=stuntdoubleType(reflect.TypeOf(jts),cbs); if fmt.Sprint(d,h,e)!="[]struct { J jsonface.J; S string; F float64; B []uint8 } false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(jts),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var im1 map[string]I
-    d,h,e=stuntdoubleType(reflect.TypeOf(im1),cbs); if fmt.Sprint(d,h,e)!="map[string]jsonface.StuntDouble true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(im1),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var jm1 map[string]J
-    d,h,e=stuntdoubleType(reflect.TypeOf(jm1),cbs); if fmt.Sprint(d,h,e)!="map[string]jsonface.J false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(jm1),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var im2 map[I]string
-    d,h,e=stuntdoubleType(reflect.TypeOf(im2),cbs); if fmt.Sprint(d,h,e)!="map[jsonface.StuntDouble]string true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(im2),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var jm2 map[J]string
-    d,h,e=stuntdoubleType(reflect.TypeOf(jm2),cbs); if fmt.Sprint(d,h,e)!="map[jsonface.J]string false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(jm2),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var im3 map[string][]I
-    d,h,e=stuntdoubleType(reflect.TypeOf(im3),cbs); if fmt.Sprint(d,h,e)!="map[string][]jsonface.StuntDouble true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(im3),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var jm3 map[string][]J
-    d,h,e=stuntdoubleType(reflect.TypeOf(jm3),cbs); if fmt.Sprint(d,h,e)!="map[string][]jsonface.J false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(jm3),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 
     var im4 map[string]struct{ I I }
-    d,h,e=stuntdoubleType(reflect.TypeOf(im4),cbs); if fmt.Sprint(d,h,e)!="map[string]struct { I jsonface.StuntDouble } true <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(im4),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
 
     var jm4 map[string]struct{ J J }
-    d,h,e=stuntdoubleType(reflect.TypeOf(jm4),cbs); if fmt.Sprint(d,h,e)!="map[string]struct { J jsonface.J } false <nil>" { panic(fmt.Sprint(d,h,e)) }
+    h,e=hasCB(reflect.TypeOf(jm4),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
 }
 
 func TestLib(t *testing.T) {
@@ -94,3 +103,78 @@ func TestLib(t *testing.T) {
     e=Unmarshal([]byte(`{"a":123}`),&im,cbs); if fmt.Sprint(im,e)!=`map[a:(123)] <nil>` { panic(fmt.Sprint(im,e)) }
 }
 
+
+type (
+    RLink  struct { V I; Next *RLink }                // Pointer chain.
+    RTree  struct { V I; Kids []RTree }               // Recursive struct through a slice.
+    RList  []struct { V I; More RList }               // Recursive slice.
+    RMap   map[string]struct { V I; Sub RMap }        // Recursive map.
+    RPlain struct { S string; Kids []RPlain }         // Recursive, but no interfaces.
+)
+
+func TestRecursiveHasCB(t *testing.T) {
+    h,e:=hasCB(reflect.TypeOf(RLink{}),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
+    h,e=hasCB(reflect.TypeOf(RTree{}),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
+    h,e=hasCB(reflect.TypeOf(RList{}),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
+    h,e=hasCB(reflect.TypeOf(RMap{}),cbs); if fmt.Sprint(h,e)!="true <nil>" { panic(fmt.Sprint(h,e)) }
+    h,e=hasCB(reflect.TypeOf(RPlain{}),cbs); if fmt.Sprint(h,e)!="false <nil>" { panic(fmt.Sprint(h,e)) }
+}
+
+func TestRecursive(t *testing.T) {
+    var l RLink
+    e:=Unmarshal([]byte(`{"V":1,"Next":{"V":2,"Next":{"V":3}}}`),&l,cbs); if fmt.Sprintf("%v %v %v %v %v",l.V,l.Next.V,l.Next.Next.V,l.Next.Next.Next,e)!=`(1) (2) (3) <nil> <nil>` { panic(fmt.Sprint(l,e)) }
+
+    var lp *RLink
+    e=Unmarshal([]byte(`{"V":1,"Next":null}`),&lp,cbs); if fmt.Sprintf("%v %v %v",lp.V,lp.Next,e)!=`(1) <nil> <nil>` { panic(fmt.Sprint(lp,e)) }
+
+    var tr RTree
+    e=Unmarshal([]byte(`{"V":"root","Kids":[{"V":"a"},{"V":"b","Kids":[{"V":"c"}]}]}`),&tr,cbs); if fmt.Sprint(tr,e)!=`{("root") [{("a") []} {("b") [{("c") []}]}]} <nil>` { panic(fmt.Sprint(tr,e)) }
+
+    var rl RList
+    e=Unmarshal([]byte(`[{"V":1,"More":[{"V":2},{"V":3,"More":[{"V":4}]}]}]`),&rl,cbs); if fmt.Sprint(rl,e)!=`[{(1) [{(2) []} {(3) [{(4) []}]}]}] <nil>` { panic(fmt.Sprint(rl,e)) }
+
+    var rm RMap
+    e=Unmarshal([]byte(`{"a":{"V":1,"Sub":{"b":{"V":2}}}}`),&rm,cbs); if fmt.Sprint(rm,e)!=`map[a:{(1) map[b:{(2) map[]}]}] <nil>` { panic(fmt.Sprint(rm,e)) }
+
+    var rp RPlain
+    e=Unmarshal([]byte(`{"S":"x","Kids":[{"S":"y"}]}`),&rp,cbs); if fmt.Sprint(rp,e)!=`{x [{y []}]} <nil>` { panic(fmt.Sprint(rp,e)) }
+
+    failCBs:=CBMap{ "jsonface.I":func(bs []byte)(interface{},error){ return nil,fmt.Errorf("bad I: %s",bs) } }
+    e=Unmarshal([]byte(`{"V":null,"Next":{"V":2}}`),&l,failCBs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "/V": bad I: null` { panic(e) }
+}
+
+func TestQualifiedTypeName(t *testing.T) {
+    var e error
+    for _,x:=range []struct{ t reflect.Type; want TypeName }{
+        {reflect.TypeOf(json.Number("")),"encoding/json.Number"},
+        {reflect.TypeOf(&json.Decoder{}),"*encoding/json.Decoder"},
+        {reflect.TypeOf(&e).Elem(),"error"},
+        {reflect.TypeOf([]int(nil)),"[]int"},
+        {reflect.TypeOf(IImpl("")),"jsonface.IImpl"},
+    } {
+        if got:=QualifiedTypeName(x.t); got!=x.want { panic(fmt.Sprint(got," != ",x.want)) }
+    }
+
+    // Qualified names are preferred over short names:
+    var c struct { C color.Color }
+    e=Unmarshal([]byte(`{"C":1}`),&c,CBMap{
+        "color.Color":func(bs []byte)(interface{},error){ return nil,errors.New("short") },
+        "image/color.Color":func(bs []byte)(interface{},error){ return color.Gray{1},nil },
+    }); if fmt.Sprint(c.C,e)!="{1} <nil>" { panic(fmt.Sprint(c.C,e)) }
+    e=Unmarshal([]byte(`{"C":1}`),&c,CBMap{ "color.Color":func(bs []byte)(interface{},error){ return color.Gray{2},nil } })
+    if fmt.Sprint(c.C,e)!="{2} <nil>" { panic(fmt.Sprint(c.C,e)) }
+
+    // Two different interfaces with the same name can't share a CB:
+    type I interface { F() }
+    var both struct { A []I; B jsonface_I }
+    e=Unmarshal([]byte(`{}`),&both,cbs)
+    if e==nil || e.Error()!=`TypeName collision: "jsonface.I" matches two different interfaces that are both named jsonface.I (one is probably declared inside a function); they can't be told apart by TypeName, so rename one of them` { panic(e) }
+    r:=NewRegistry()
+    r.Register("jsonface.I",cbs["jsonface.I"])
+    e=r.Unmarshal([]byte(`[]`),&both.B); if e!=nil { panic(e) }
+    e=r.Unmarshal([]byte(`[]`),&both.A); if e==nil { panic("expected collision") }  // Detected across calls, too.
+    var ve *ValidationError
+    e=r.Validate(reflect.TypeOf(both)); if !errors.As(e,&ve) || fmt.Sprint(ve.Ambiguous)!="[jsonface.I]" { panic(e) }
+}
+
+type jsonface_I=I
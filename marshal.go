@@ -0,0 +1,294 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "bytes"
+    "reflect"
+    "sort"
+    "strconv"
+    "encoding"
+    "encoding/json"
+    "sync"
+)
+
+var _JSON_MARSHALER_TYPE=reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var _TEXT_MARSHALER_TYPE=reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// Marshal is like json.Marshal, but whenever it finds a value stored in an
+// interface that has an entry in the VariantsMap, it adds the discriminator for
+// the value's concrete type.  This means that one set of Variants can drive
+// both marshalling and unmarshalling, so you don't need to write a MarshalJSON
+// method for each concrete type.
+//
+// The discriminator is only added when the interface type is known, so if you
+// want to marshal an interface value directly, pass a pointer to it:
+//
+//     var s Shape = Circle{2.5}
+//     bs,err := jsonface.Marshal(&s, vm)
+func Marshal(v interface{}, vm VariantsMap) ([]byte,error) {
+    var buf bytes.Buffer
+    e:=marshalValue(&buf,reflect.ValueOf(v),&marshalState{vm:vm}); if e!=nil { return nil,e }
+    return buf.Bytes(),nil
+}
+
+// MarshalIndent is like Marshal, but applies json.Indent to format the output.
+func MarshalIndent(v interface{}, prefix, indent string, vm VariantsMap) ([]byte,error) {
+    bs,e:=Marshal(v,vm); if e!=nil { return nil,e }
+    var buf bytes.Buffer
+    e=json.Indent(&buf,bs,prefix,indent); if e!=nil { return nil,e }
+    return buf.Bytes(),nil
+}
+
+// _START_DETECTING_CYCLES_AFTER is the nesting depth at which we start looking
+// for cycles.  Like encoding/json, we don't bother for shallow values, since
+// the bookkeeping is relatively expensive.
+const _START_DETECTING_CYCLES_AFTER=1000
+
+// marshalState is the state of one call to Marshal().
+type marshalState struct {
+    vm       VariantsMap
+    ptrLevel uint
+    ptrSeen  map[interface{}]struct{}  // The pointers, maps, and slices that we are inside of (after _START_DETECTING_CYCLES_AFTER).
+}
+
+// enter records that we are descending into the pointer, map, or slice 'v',
+// and returns an error if we are already inside of it.  Each successful call
+// must be followed by a call to leave().
+func (me *marshalState) enter(v reflect.Value) error {
+    me.ptrLevel++
+    if me.ptrLevel<=_START_DETECTING_CYCLES_AFTER { return nil }
+    key:=me.ptrKey(v)
+    if _,has:=me.ptrSeen[key]; has {
+        me.ptrLevel--
+        return &json.UnsupportedValueError{Value:v, Str:fmt.Sprintf("encountered a cycle via %v",v.Type())}
+    }
+    if me.ptrSeen==nil { me.ptrSeen=map[interface{}]struct{}{} }
+    me.ptrSeen[key]=struct{}{}
+    return nil
+}
+
+// leave undoes enter().
+func (me *marshalState) leave(v reflect.Value) {
+    if me.ptrLevel>_START_DETECTING_CYCLES_AFTER { delete(me.ptrSeen,me.ptrKey(v)) }
+    me.ptrLevel--
+}
+
+// ptrKey identifies the memory that 'v' refers to, the same way encoding/json
+// does.  A pointer is identified by its type too, since a pointer to a struct
+// and a pointer to its first field have the same address.  A slice is
+// identified by its data pointer and its length, since sub-slices that share
+// the same data are not cycles.
+func (me *marshalState) ptrKey(v reflect.Value) interface{} {
+    switch v.Kind() {
+    case reflect.Ptr: return v.Interface()
+    case reflect.Slice: return struct{ ptr uintptr; len int }{v.Pointer(),v.Len()}
+    default: return v.Pointer()
+    }
+}
+
+// marshalValue writes the JSON encoding of 'v' to 'buf'.  It only walks through
+// the parts of 'v' that might contain interfaces; everything else is handed to
+// encoding/json directly.
+func marshalValue(buf *bytes.Buffer, v reflect.Value, ms *marshalState) error {
+    if !v.IsValid() { buf.WriteString("null"); return nil }
+    t:=v.Type()
+    if (t.Kind()==reflect.Ptr || t.Kind()==reflect.Interface) && v.IsNil() { buf.WriteString("null"); return nil }
+    vm:=ms.vm
+    if len(vm)==0 || isMarshaler(t) || !hasInterfaceType(t) { return marshalJSON(buf,v) }
+
+    switch t.Kind() {
+    case reflect.Interface:
+        name,has:=lookupName(vm,t)
+        vs:=vm[name]
+        if !has { return marshalValue(buf,v.Elem(),ms) }  // We don't know this interface, but its value might contain interfaces that we do know.
+        return vs.marshal(buf,v.Elem(),ms)
+    case reflect.Ptr:
+        e:=ms.enter(v); if e!=nil { return e }
+        defer ms.leave(v)
+        return marshalValue(buf,v.Elem(),ms)
+    case reflect.Array,reflect.Slice:
+        if t.Kind()==reflect.Slice {
+            if v.IsNil() { buf.WriteString("null"); return nil }
+            e:=ms.enter(v); if e!=nil { return e }
+            defer ms.leave(v)
+        }
+        buf.WriteByte('[')
+        for i:=0;i<v.Len();i++ {
+            if i>0 { buf.WriteByte(',') }
+            e:=marshalValue(buf,v.Index(i),ms); if e!=nil { return elemErr("slice element error: %w",e) }
+        }
+        buf.WriteByte(']')
+        return nil
+    case reflect.Map:
+        if v.IsNil() { buf.WriteString("null"); return nil }
+        e:=ms.enter(v); if e!=nil { return e }
+        defer ms.leave(v)
+        type kv struct { k string; v reflect.Value }
+        var kvs []kv
+        iter:=v.MapRange()
+        for iter.Next() {
+            k,e:=marshalKey(iter.Key()); if e!=nil { return e }
+            kvs=append(kvs,kv{k,iter.Value()})
+        }
+        sort.Slice(kvs,func(i,j int) bool { return kvs[i].k<kvs[j].k })
+        buf.WriteByte('{')
+        for i,x:=range kvs {
+            if i>0 { buf.WriteByte(',') }
+            e:=marshalJSON(buf,reflect.ValueOf(x.k)); if e!=nil { return e }
+            buf.WriteByte(':')
+            e=marshalValue(buf,x.v,ms); if e!=nil { return elemErr("map value error: %w",e) }
+        }
+        buf.WriteByte('}')
+        return nil
+    case reflect.Struct:
+        buf.WriteByte('{')
+        first:=true
+        for _,f:=range jsonFields(t) {
+            fv,ok:=fieldByIndexNoAlloc(v,f.index); if !ok { continue }  // A nil embedded pointer.
+            if f.omitEmpty && isEmptyValue(fv) { continue }
+            if !first { buf.WriteByte(',') }
+            first=false
+            e:=marshalJSON(buf,reflect.ValueOf(f.name)); if e!=nil { return e }
+            buf.WriteByte(':')
+            if f.quoted {
+                var inner bytes.Buffer
+                e=marshalJSON(&inner,fv); if e!=nil { return e }
+                if fv.Kind()==reflect.Ptr && fv.IsNil() { buf.Write(inner.Bytes()) } else { e=marshalJSON(buf,reflect.ValueOf(inner.String())) }
+            } else { e=marshalValue(buf,fv,ms) }
+            if e!=nil { return elemErr("struct field error: %w",e) }
+        }
+        buf.WriteByte('}')
+        return nil
+    default: return marshalJSON(buf,v)
+    }
+}
+
+// elemErr is like fmtErr, but it passes cycle errors through unchanged, like
+// encoding/json does.  Otherwise they would collect one message per level of
+// the cycle.
+func elemErr(msg string, e error) error {
+    if _,ok:=e.(*json.UnsupportedValueError); ok { return e }
+    return fmtErr(msg,e)
+}
+
+// marshal writes the concrete value 'v' along with its discriminator.
+func (me *Variants) marshal(buf *bytes.Buffer, v reflect.Value, ms *marshalState) error {
+    tag,has:=me.tags[v.Type()]; if !has { return fmt.Errorf("%w for type %v",ErrUnknownVariant,v.Type()) }
+    if me.style==Untagged { return marshalValue(buf,v,ms) }
+    var content bytes.Buffer
+    e:=marshalValue(&content,v,ms); if e!=nil { return e }
+    bs:=content.Bytes()
+    switch me.style {
+    case InternalTag:
+        if len(bs)==0 || bs[0]!='{' { return fmt.Errorf("variant %q does not marshal to a JSON object: %s",tag,bs) }
+        buf.WriteByte('{')
+        e=marshalMember(buf,me.tagKey,tag); if e!=nil { return e }
+        if len(bs)>2 { buf.WriteByte(',') }
+        buf.Write(bs[1:])
+    case AdjacentTag:
+        buf.WriteByte('{')
+        e=marshalMember(buf,me.tagKey,tag); if e!=nil { return e }
+        buf.WriteByte(',')
+        e=marshalJSON(buf,reflect.ValueOf(me.contentKey)); if e!=nil { return e }
+        buf.WriteByte(':'); buf.Write(bs); buf.WriteByte('}')
+    case ExternalTag:
+        buf.WriteByte('{')
+        e=marshalJSON(buf,reflect.ValueOf(tag)); if e!=nil { return e }
+        buf.WriteByte(':'); buf.Write(bs); buf.WriteByte('}')
+    }
+    return nil
+}
+
+// marshalMember writes a "key":"value" pair.
+func marshalMember(buf *bytes.Buffer, key, value string) error {
+    e:=marshalJSON(buf,reflect.ValueOf(key)); if e!=nil { return e }
+    buf.WriteByte(':')
+    return marshalJSON(buf,reflect.ValueOf(value))
+}
+
+func marshalJSON(buf *bytes.Buffer, v reflect.Value) error {
+    var x interface{}
+    if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(_JSON_MARSHALER_TYPE) { x=v.Addr().Interface() } else { x=v.Interface() }
+    bs,e:=json.Marshal(x); if e!=nil { return e }
+    buf.Write(bs)
+    return nil
+}
+
+// isMarshaler reports whether 't' (or a pointer to 't') has custom marshaling behavior.
+func isMarshaler(t reflect.Type) bool {
+    pt:=reflect.PtrTo(t)
+    return t.Implements(_JSON_MARSHALER_TYPE) || pt.Implements(_JSON_MARSHALER_TYPE) ||
+           t.Implements(_TEXT_MARSHALER_TYPE) || pt.Implements(_TEXT_MARSHALER_TYPE)
+}
+
+var interfaceTypeCache sync.Map  // reflect.Type --> bool
+
+// hasInterfaceType reports whether any type reachable from 't' is an interface.
+func hasInterfaceType(t reflect.Type) bool {
+    if has,ok:=interfaceTypeCache.Load(t); ok { return has.(bool) }
+    has:=hasInterfaceTypeR(t,map[reflect.Type]bool{})
+    interfaceTypeCache.Store(t,has)
+    return has
+}
+func hasInterfaceTypeR(t reflect.Type, seen map[reflect.Type]bool) bool {
+    if seen[t] || isMarshaler(t) { return false }
+    seen[t]=true
+    switch t.Kind() {
+    case reflect.Interface:
+        return true
+    case reflect.Ptr,reflect.Array,reflect.Slice:
+        return hasInterfaceTypeR(t.Elem(),seen)
+    case reflect.Map:
+        return hasInterfaceTypeR(t.Elem(),seen)
+    case reflect.Struct:
+        for _,f:=range jsonFields(t) {
+            if hasInterfaceTypeR(f.typ,seen) { return true }
+        }
+    }
+    return false
+}
+
+// marshalKey converts a map key to a JSON object key, using the same rules as encoding/json.
+func marshalKey(k reflect.Value) (string,error) {
+    if k.Kind()==reflect.String { return k.String(),nil }
+    if tm,ok:=k.Interface().(encoding.TextMarshaler); ok {
+        if k.Kind()==reflect.Ptr && k.IsNil() { return "",nil }
+        bs,e:=tm.MarshalText(); return string(bs),e
+    }
+    switch k.Kind() {
+    case reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64:
+        return strconv.FormatInt(k.Int(),10),nil
+    case reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64,reflect.Uintptr:
+        return strconv.FormatUint(k.Uint(),10),nil
+    }
+    return "",fmt.Errorf("unsupported map key type: %v",k.Type())
+}
+
+// fieldByIndexNoAlloc is like reflect.Value.FieldByIndex, but it reports
+// failure instead of panicking when it finds a nil embedded pointer.
+func fieldByIndexNoAlloc(v reflect.Value, index []int) (reflect.Value,bool) {
+    for n,i:=range index {
+        if n>0 && v.Kind()==reflect.Ptr {
+            if v.IsNil() { return v,false }
+            v=v.Elem()
+        }
+        v=v.Field(i)
+    }
+    return v,true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+    switch v.Kind() {
+    case reflect.Array,reflect.Map,reflect.Slice,reflect.String: return v.Len()==0
+    case reflect.Bool: return !v.Bool()
+    case reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64: return v.Int()==0
+    case reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64,reflect.Uintptr: return v.Uint()==0
+    case reflect.Float32,reflect.Float64: return v.Float()==0
+    case reflect.Interface,reflect.Ptr: return v.IsNil()
+    }
+    return false
+}
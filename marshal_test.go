@@ -0,0 +1,99 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "strings"
+    "errors"
+    "encoding/json"
+)
+
+type (
+    MText  int
+    MEmbed struct { E I }
+    mAll   struct {
+        *MEmbed
+        Is       []I
+        Ptr      *I
+        Omit     I               `json:",omitempty"`
+        Quoted   int             `json:"q,string"`
+        Keys     map[MText]I
+        Any      interface{}
+        Nil      I
+        private  I
+    }
+)
+func (me MText) MarshalText() ([]byte,error) { return []byte(fmt.Sprintf("k%d",int(me))),nil }
+
+func TestMarshal(t *testing.T) {
+    vs,e:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{}, "P":&VPtr{} }); if e!=nil { panic(e) }
+    vm:=VariantsMap{ "jsonface.I":vs }
+
+    var i I=VB{"s",VA{1}}
+    bs,e:=Marshal(&i,vm); if fmt.Sprintf("%s %v",bs,e)!=`{"Type":"B","S":"s","Kid":{"Type":"A","N":1}} <nil>` { panic(fmt.Sprintf("%s %v",bs,e)) }
+    // Without a pointer, the interface type is not known, so no discriminator is added at the top level:
+    bs,e=Marshal(i,vm); if fmt.Sprintf("%s %v",bs,e)!=`{"S":"s","Kid":{"Type":"A","N":1}} <nil>` { panic(fmt.Sprintf("%s %v",bs,e)) }
+
+    var i2 I
+    e=Unmarshal([]byte(`{"Type":"B","S":"s","Kid":{"Type":"A","N":1}}`),&i2,vm.CBMap()); if fmt.Sprint(i2,e)!=fmt.Sprint(i,nil) { panic(fmt.Sprint(i2,e)) }
+
+    m:=mAll{
+        MEmbed: &MEmbed{VA{2}},
+        Is:     []I{VA{3},&VPtr{4.5},nil},
+        Ptr:    &i,
+        Quoted: 6,
+        Keys:   map[MText]I{ 8:VA{8}, 7:VA{7} },
+        Any:    []interface{}{ VA{9}, map[string]I{"x":VA{10}} },
+    }
+    bs,e=Marshal(m,vm)
+    if fmt.Sprintf("%s %v",bs,e)!=`{"E":{"Type":"A","N":2},"Is":[{"Type":"A","N":3},{"Type":"P","X":4.5},null],"Ptr":{"Type":"B","S":"s","Kid":{"Type":"A","N":1}},"q":"6","Keys":{"k7":{"Type":"A","N":7},"k8":{"Type":"A","N":8}},"Any":[{"N":9},{"x":{"Type":"A","N":10}}],"Nil":null} <nil>` { panic(fmt.Sprintf("%s %v",bs,e)) }
+
+    bs,e=MarshalIndent(struct{ I I }{VA{1}},">","  ",vm); if fmt.Sprintf("%s %v",bs,e)!="{\n>  \"I\": {\n>    \"Type\": \"A\",\n>    \"N\": 1\n>  }\n>} <nil>" { panic(fmt.Sprintf("%s %v",bs,e)) }
+
+    _,e=Marshal([]I{IImpl("x")},vm); if fmt.Sprint(e)!="slice element error: unknown variant for type jsonface.IImpl" { panic(e) }
+    vs2,e:=NewVariants("Type",map[string]interface{}{ "X":IImpl("") }); if e!=nil { panic(e) }
+    _,e=Marshal([]I{IImpl("x")},VariantsMap{ "jsonface.I":vs2 }); if e==nil || !strings.Contains(e.Error(),`variant "X" does not marshal to a JSON object: "x"`) { panic(e) }
+
+    // Values without any interfaces are marshalled by encoding/json:
+    bs,e=Marshal(map[string]int{"b":2,"a":1},vm); if fmt.Sprintf("%s %v",bs,e)!=`{"a":1,"b":2} <nil>` { panic(fmt.Sprintf("%s %v",bs,e)) }
+}
+
+type Cyc struct { V I; N *Cyc; L []*Cyc; M map[string]*Cyc }
+
+type CycOuter struct { Head VB; V I }
+func (me *CycOuter) F() {}
+
+func TestMarshalCycle(t *testing.T) {
+    vs,e:=NewVariants("Type",map[string]interface{}{ "A":VA{} }); if e!=nil { panic(e) }
+    vm:=VariantsMap{ "jsonface.I":vs }
+    for _,c:=range []func(c *Cyc){
+        func(c *Cyc) { c.N=c },
+        func(c *Cyc) { c.L=[]*Cyc{c} },
+        func(c *Cyc) { c.M=map[string]*Cyc{"m":c} },
+    } {
+        x:=&Cyc{V:VA{1}}; c(x)
+        _,jsonE:=json.Marshal(x)
+        _,e=Marshal(x,vm)
+        var uve *json.UnsupportedValueError
+        if !errors.As(e,&uve) || e.Error()!=jsonE.Error() { panic(fmt.Sprint(e," != ",jsonE)) }
+    }
+
+    // Deep values without cycles are fine:
+    x:=&Cyc{V:VA{1}}
+    for i:=0;i<2*_START_DETECTING_CYCLES_AFTER;i++ { x=&Cyc{N:x} }
+    bs,e:=Marshal(x,vm); if e!=nil || !strings.Contains(string(bs),`{"V":{"Type":"A","N":1},"N":null`) { panic(e) }
+
+    // A pointer to a struct and a pointer to its first field are not a cycle:
+    vs2,e:=NewVariants("Type",map[string]interface{}{ "B":VB{}, "PB":&VB{}, "O":&CycOuter{} }); if e!=nil { panic(e) }
+    o:=&CycOuter{Head:VB{S:"h"}}; o.V=&o.Head
+    x=&Cyc{V:o}
+    for i:=0;i<2*_START_DETECTING_CYCLES_AFTER;i++ { x=&Cyc{N:x} }
+    bs,e=Marshal(x,VariantsMap{ "jsonface.I":vs2 }); if e!=nil || !strings.Contains(string(bs),`{"Type":"O","Head":{"S":"h","Kid":null},"V":{"Type":"PB","S":"h","Kid":null}}`) { panic(e) }
+
+    // The Iface wrapper uses the same path:
+    snap:=globalRegistry.Snapshot(); defer globalRegistry.Restore(snap)
+    globalRegistry.Restore(RegistrySnapshot{})
+    registerGlobalVariants("jsonface.I",vs)
+    y:=&Cyc{V:VA{2}}; y.N=y
+    _,e=json.Marshal(Iface[*Cyc]{y}); if e==nil || !strings.Contains(e.Error(),"encountered a cycle via *jsonface.Cyc") { panic(e) }
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "errors"
+    "reflect"
+    "sync"
+)
+
+// A Plan is a pre-computed unmarshalling strategy for one destination type and
+// one CBMap.  Unmarshal() must analyze your destination type every time it is
+// called, which requires a lot of reflection work.  If you are unmarshalling
+// many values of the same type (for example, millions of []Event payloads), you
+// can do that work once with Compile() and then re-use the Plan.
+//
+// A Plan is safe for concurrent use.
+type Plan struct {
+    typ   reflect.Type
+    root  *node
+    cache *planCache
+}
+
+// node describes how to decode one type.  Nodes form a graph that mirrors the
+// destination type.  Recursive types produce cycles in the graph.
+type node struct {
+    typ    reflect.Type
+    hasCB  bool       // False if no CB can be reached from here; encoding/json can handle it alone.
+    raw    bool       // True if we need the raw bytes of the value (an interface, or pointer to one).
+    cb     CB         // For interfaces.
+    ctxCB  ContextCB  // For interfaces.  If it is set, it is used instead of cb.
+    name   TypeName   // For interfaces.
+    elem   *node      // For pointers, arrays, slices, and map values.
+    key    *node      // For map keys.
+    fields []fieldNode           // For structs.
+    byName map[string]int        // For structs.  Exact field name --> index into fields.
+}
+
+type fieldNode struct {
+    jsonField
+    node *node
+}
+
+// planCache holds all the Plans and nodes that were computed for one CBMap.
+// It is shared by all Plans compiled together, and by the global registry.
+type planCache struct {
+    mu    sync.RWMutex
+    cbs    CBMap
+    ctxCBs map[TypeName]ContextCB  // CBs that want a DecodeContext.  Each one also has a plain version in cbs.
+    reg    *Registry               // The Registry that the CBs came from, or nil.
+    plans  map[reflect.Type]*Plan
+    nodes  map[reflect.Type]*node
+    names  map[TypeName]reflect.Type  // The interface that uses each CB, for detecting collisions.
+}
+
+func newPlanCache(cbs CBMap) *planCache {
+    return &planCache{cbs:cbs, plans:map[reflect.Type]*Plan{}, nodes:map[reflect.Type]*node{}, names:map[TypeName]reflect.Type{}}
+}
+
+func (me *planCache) plan(t reflect.Type) (*Plan,error) {
+    if t==nil { return nil,errors.New("nil type!  If you are trying to get the type of an interface, you must use some indirection because Go discards the types of interface values at compile time.  See https://golang.org/pkg/reflect/#TypeOf .  Example: var x MyInterface; reflect.ValueOf(&x).Elem().Type()") }
+    me.mu.RLock(); p,has:=me.plans[t]; me.mu.RUnlock()
+    if has { return p,nil }
+    me.mu.Lock(); defer me.mu.Unlock()
+    if p,has:=me.plans[t]; has { return p,nil }  // Another goroutine beat us.
+    e:=me.checkCollisions(t); if e!=nil { return nil,e }
+    p=&Plan{typ:t, root:me.node(t), cache:me}
+    me.plans[t]=p
+    return p,nil
+}
+
+// checkCollisions makes sure that a CB is never used for two different
+// interfaces with the same short name (like github.com/a/models.Event and
+// github.com/b/models.Event).  The caller must hold the write lock.
+func (me *planCache) checkCollisions(t reflect.Type) (e error) {
+    interfaceTypes(t,map[reflect.Type]bool{},func(it reflect.Type) {
+        name,has:=lookupName(me.cbs,it)
+        if !has || e!=nil { return }
+        if prev,has:=me.names[name]; has && prev!=it {
+            q1,q2:=QualifiedTypeName(prev),QualifiedTypeName(it)
+            if q1==q2 {
+                // Types declared inside functions have the same names as package-level types, so qualifying them doesn't help.
+                e=fmt.Errorf("TypeName collision: %q matches two different interfaces that are both named %v (one is probably declared inside a function); they can't be told apart by TypeName, so rename one of them",name,q1)
+            } else {
+                e=fmt.Errorf("TypeName collision: %q matches both %v and %v; use their qualified TypeNames instead",name,q1,q2)
+            }
+            return
+        }
+        me.names[name]=it
+    })
+    return e
+}
+
+// node builds the node for type 't'.  The caller must hold the write lock.
+// New nodes are stored before their children are built, so that recursive
+// types link back to the node that is already in progress rather than
+// recursing forever.
+func (me *planCache) node(t reflect.Type) *node {
+    if n,has:=me.nodes[t]; has { return n }
+    n:=&node{typ:t, hasCB:hasCBType(t,me.cbs,map[reflect.Type]bool{})}
+    me.nodes[t]=n
+    if !n.hasCB { return n }
+    switch t.Kind() {
+    case reflect.Interface:
+        n.name,_=lookupName(me.cbs,t); n.cb=me.cbs[n.name]; n.ctxCB=me.ctxCBs[n.name]; n.raw=true
+    case reflect.Ptr:
+        n.elem=me.node(t.Elem()); n.raw=n.elem.raw
+    case reflect.Array,reflect.Slice:
+        n.elem=me.node(t.Elem())
+    case reflect.Map:
+        n.key=me.node(t.Key()); n.elem=me.node(t.Elem())
+    case reflect.Struct:
+        n.byName=map[string]int{}
+        for _,f:=range jsonFields(t) {
+            n.byName[f.name]=len(n.fields)
+            n.fields=append(n.fields,fieldNode{f,me.node(f.typ)})
+        }
+    }
+    return n
+}
+
+// hasCBType reports whether any type reachable from 't' is an interface with an
+// entry in the CBMap.  Types that have their own unmarshalling methods are not
+// descended into, since we must not bypass their custom behavior.
+func hasCBType(t reflect.Type, cbs CBMap, seen map[reflect.Type]bool) bool {
+    if seen[t] || isUnmarshaler(t) { return false }
+    seen[t]=true
+    switch t.Kind() {
+    case reflect.Interface:
+        _,has:=lookupName(cbs,t); return has
+    case reflect.Ptr,reflect.Array,reflect.Slice:
+        return hasCBType(t.Elem(),cbs,seen)
+    case reflect.Map:
+        return hasCBType(t.Key(),cbs,seen) || hasCBType(t.Elem(),cbs,seen)
+    case reflect.Struct:
+        for _,f:=range jsonFields(t) {
+            if hasCBType(f.typ,cbs,seen) { return true }
+        }
+    }
+    return false
+}
+
+// interfaceTypes calls 'fn' for each interface type that is reachable from 't',
+// using the same traversal as hasCBType.
+func interfaceTypes(t reflect.Type, seen map[reflect.Type]bool, fn func(reflect.Type)) {
+    if seen[t] || isUnmarshaler(t) { return }
+    seen[t]=true
+    switch t.Kind() {
+    case reflect.Interface:
+        fn(t)
+    case reflect.Ptr,reflect.Array,reflect.Slice:
+        interfaceTypes(t.Elem(),seen,fn)
+    case reflect.Map:
+        interfaceTypes(t.Key(),seen,fn); interfaceTypes(t.Elem(),seen,fn)
+    case reflect.Struct:
+        for _,f:=range jsonFields(t) { interfaceTypes(f.typ,seen,fn) }
+    }
+}
+
+// isUnmarshaler reports whether 't' (or a pointer to 't') has custom unmarshaling behavior.
+func isUnmarshaler(t reflect.Type) bool {
+    pt:=reflect.PtrTo(t)
+    return t.Implements(_JSON_UNMARSHALER_TYPE) || pt.Implements(_JSON_UNMARSHALER_TYPE) ||
+           t.Implements(_TEXT_UNMARSHALER_TYPE) || pt.Implements(_TEXT_UNMARSHALER_TYPE)
+}
+
+// Compile computes a Plan for unmarshalling into values of type 't' using the
+// given CBMap.  The CBMap is copied, so later modifications to it do not affect
+// the Plan.
+//
+// Example:  plan,err := jsonface.Compile(reflect.TypeOf([]Event(nil)), cbs)
+func Compile(t reflect.Type, cbs CBMap) (*Plan,error) {
+    if t==nil { return nil,errors.New("nil type") }
+    cbsCopy:=make(CBMap,len(cbs))
+    for k,v:=range cbs { cbsCopy[k]=v }
+    return newPlanCache(cbsCopy).plan(t)
+}
+
+// Type returns the destination type that this Plan was compiled for.
+func (me *Plan) Type() reflect.Type { return me.typ }
+
+// Unmarshal is like the Unmarshal() function, but it uses the pre-computed
+// Plan.  destPtr must be a pointer to a value of the Plan's Type().
+func (me *Plan) Unmarshal(bs []byte, destPtr interface{}) error {
+    destPtrV,e:=checkDestPtr(destPtr); if e!=nil { return e }
+    if destPtrV.Type().Elem()!=me.typ { return fmt.Errorf("destPtr type mismatch: Plan is for %v, not %v",me.typ,destPtrV.Type().Elem()) }
+    return me.unmarshal(nil,bs,destPtrV,Options{})
+}
+
+func checkDestPtr(destPtr interface{}) (reflect.Value,error) {
+    destPtrV:=reflect.ValueOf(destPtr)
+    if !destPtrV.IsValid() { return destPtrV,errors.New("invalid destPtr") }
+    if destPtrV.Kind()!=reflect.Ptr { return destPtrV,errors.New("destPtr is not a pointer") }
+    if destPtrV.IsNil() { return destPtrV,errors.New("nil destPtr") }
+    return destPtrV,nil
+}
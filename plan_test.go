@@ -0,0 +1,58 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "reflect"
+    "strings"
+)
+
+func TestCompile(t *testing.T) {
+    myCBs:=CBMap{ "jsonface.I":cbs["jsonface.I"] }
+    plan,e:=Compile(reflect.TypeOf([]I(nil)),myCBs); if e!=nil { panic(e) }
+    delete(myCBs,"jsonface.I")  // Compile copies the CBMap, so this has no effect on the Plan.
+    if fmt.Sprint(plan.Type(),plan.root.hasCB,plan.root.elem.cb!=nil)!="[]jsonface.I true true" { panic(plan.Type()) }
+
+    for i:=0;i<3;i++ {
+        var is []I
+        e=plan.Unmarshal([]byte(`[1,"2"]`),&is); if fmt.Sprint(is,e)!=`[(1) ("2")] <nil>` { panic(fmt.Sprint(is,e)) }
+    }
+
+    var wrong []J
+    e=plan.Unmarshal([]byte(`[]`),&wrong); if e==nil || !strings.Contains(e.Error(),"type mismatch") { panic(e) }
+    e=plan.Unmarshal([]byte(`[]`),nil); if fmt.Sprint(e)!="invalid destPtr" { panic(e) }
+
+    // Sub-Plans for recursive types are shared through the cache:
+    plan,e=Compile(reflect.TypeOf(RLink{}),cbs); if e!=nil { panic(e) }
+    var l RLink
+    e=plan.Unmarshal([]byte(`{"V":1,"Next":{"V":2}}`),&l); if fmt.Sprintf("%v %v %v",l.V,l.Next.V,e)!="(1) (2) <nil>" { panic(fmt.Sprint(l,e)) }
+    if len(plan.cache.plans)!=1 || plan.root.fields[1].node.elem!=plan.root { panic("recursive node not shared") }
+
+    _,e=Compile(nil,cbs); if fmt.Sprint(e)!="nil type" { panic(e) }
+}
+
+type benchEvent struct {
+    Name string
+    When int64
+    What I
+    Tags []string
+}
+
+var benchBytes=[]byte(`[{"Name":"a","When":1,"What":"x","Tags":["t1","t2"]},{"Name":"b","When":2,"What":{"k":"v"},"Tags":[]},{"Name":"c","When":3,"What":[1,2,3],"Tags":["t3"]}]`)
+
+func BenchmarkUnmarshal(b *testing.B) {
+    b.ReportAllocs()
+    for i:=0;i<b.N;i++ {
+        var evs []benchEvent
+        e:=Unmarshal(benchBytes,&evs,cbs); if e!=nil { panic(e) }
+    }
+}
+
+func BenchmarkPlanUnmarshal(b *testing.B) {
+    plan,e:=Compile(reflect.TypeOf([]benchEvent(nil)),cbs); if e!=nil { panic(e) }
+    b.ReportAllocs(); b.ResetTimer()
+    for i:=0;i<b.N;i++ {
+        var evs []benchEvent
+        e:=plan.Unmarshal(benchBytes,&evs); if e!=nil { panic(e) }
+    }
+}
@@ -0,0 +1,511 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "context"
+    "errors"
+    "io"
+    "reflect"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "encoding/json"
+)
+
+// A Registry is a set of CBs (and Variants) that can be modified safely while
+// it is being used.  It sits between the global callback registry and a bare
+// CBMap:  a library can ship its own Registry without touching package-level
+// state, and an application can combine several Registries into one.
+//
+// Registries can be layered with NewChild().  A child Registry falls back to
+// its parent for any TypeName that it doesn't define itself, so you can
+// customize a few CBs (for example, for one tenant) without copying all the
+// others.
+//
+// The global callback registry (used by AddGlobalCB() and GlobalUnmarshal())
+// is itself a Registry; see GlobalRegistry().
+//
+// A Registry must be created with NewRegistry() or NewChild().  It is safe for
+// concurrent use.  The contents of a Registry are published as immutable
+// snapshots, so unmarshalling never takes a lock:  many goroutines can
+// unmarshal at the same time, and CBs can safely call back into the Registry
+// (to unmarshal nested values, or even to register more CBs).  Each change to
+// a Registry copies its contents, so registration is a bit slower, but that is
+// normally only done during program initialization.
+type Registry struct {
+    mu     sync.Mutex    // Serializes changes.  Readers don't lock.
+    parent *Registry
+    state  atomic.Value  // *registryState
+    plans  atomic.Value  // *registryPlans
+}
+
+// registryState is a snapshot of the contents of a Registry.  It is never
+// modified after it is published; changes are made to a copy.
+type registryState struct {
+    cbs      CBMap
+    ctxCBs   map[TypeName]ContextCB
+    variants VariantsMap
+    pending  map[TypeName]map[string]interface{}  // Variants added before RegisterVariants().  The inner maps are never modified.
+    sites    map[TypeName]string             // Where each CB was registered, as "file:line".
+    tagSites map[TypeName]map[string]string  // Where each variant tag was registered.  The inner maps are never modified.
+    gen      uint64               // Incremented for every new snapshot.
+    frozen   bool
+}
+
+// registryPlans holds the Plans computed from the CBs of a whole chain of
+// Registries, and the generation() that they were computed for.
+type registryPlans struct {
+    plans *planCache
+    gen   uint64
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+    me:=&Registry{}
+    me.state.Store(newRegistryState(0))
+    return me
+}
+
+func newRegistryState(gen uint64) *registryState {
+    return &registryState{cbs:CBMap{}, ctxCBs:map[TypeName]ContextCB{}, variants:VariantsMap{}, pending:map[TypeName]map[string]interface{}{}, sites:map[TypeName]string{}, tagSites:map[TypeName]map[string]string{}, gen:gen}
+}
+
+// load returns the current snapshot.
+func (me *Registry) load() *registryState { return me.state.Load().(*registryState) }
+
+// ErrFrozen is returned when you try to change a Registry after Freeze().
+var ErrFrozen=errors.New("registry is frozen")
+
+// update applies 'fn' to a copy of the current snapshot and publishes the
+// result, unless 'fn' returns an error.
+func (me *Registry) update(fn func(s *registryState) error) error {
+    me.mu.Lock(); defer me.mu.Unlock()
+    old:=me.load()
+    if old.frozen { return ErrFrozen }
+    s:=newRegistryState(old.gen+1)
+    for k,v:=range old.cbs { s.cbs[k]=v }
+    for k,v:=range old.ctxCBs { s.ctxCBs[k]=v }
+    for k,v:=range old.variants { s.variants[k]=v }
+    for k,v:=range old.pending { s.pending[k]=v }
+    for k,v:=range old.sites { s.sites[k]=v }
+    for k,v:=range old.tagSites { s.tagSites[k]=v }
+    e:=fn(s); if e!=nil { return e }
+    me.state.Store(s)
+    return nil
+}
+
+// NewChild returns a new, empty Registry that uses 'me' as its parent.  CBs
+// registered in the child take precedence over the parent's CBs with the same
+// TypeName.  Later changes to the parent are seen by the child.
+//
+// Nested interfaces within Variants are unmarshalled with the Registry that
+// started the unmarshalling, so the child's CBs are also used for interfaces
+// nested inside the parent's Variants.
+func (me *Registry) NewChild() *Registry {
+    r:=NewRegistry(); r.parent=me
+    return r
+}
+
+// Parent returns the parent of a Registry created by NewChild(), or nil.
+func (me *Registry) Parent() *Registry { return me.parent }
+
+// Register adds a CB to the Registry.  If a CB is already defined for 'name'
+// in this Registry, it returns a *DuplicateCBError, which tells you where both
+// CBs were registered; use Replace() if you really want to overwrite it.  CBs
+// defined by a parent Registry don't count, since the point of a child is to
+// override them.
+func (me *Registry) Register(name TypeName, cb CB) error {
+    site:=callSite()
+    return me.update(func(s *registryState) error {
+        if s.has(name) { return &DuplicateCBError{Name:name, First:s.sites[name], Second:site} }
+        s.cbs[name]=cb; s.sites[name]=site
+        return nil
+    })
+}
+
+// RegisterVariants adds the CB of a Variants to the Registry, like Register().
+// Nested interfaces are unmarshalled with this same Registry, and the Variants
+// are also used by the Registry's Marshal() method.  Any variants that were
+// already added for 'name' with AddVariants() are included.
+func (me *Registry) RegisterVariants(name TypeName, vs *Variants) error {
+    site:=callSite()
+    return me.update(func(s *registryState) error {
+        if s.has(name) { return &DuplicateCBError{Name:name, First:s.sites[name], Second:site} }
+        tagSites:=map[string]string{}
+        for _,tag:=range vs.order { tagSites[tag]=site }
+        if pending,has:=s.pending[name]; has {
+            for _,tag:=range sortedTags(pending) {
+                if _,has:=vs.types[tag]; has { return &VariantConflictError{Name:name, Tag:tag, First:s.tagSites[name][tag], Second:site} }
+                tagSites[tag]=s.tagSites[name][tag]
+            }
+            var e error
+            vs,e=vs.With(pending); if e!=nil { return e }
+            delete(s.pending,name)
+        }
+        s.variants[name]=vs; s.sites[name]=site
+        s.tagSites[name]=tagSites
+        return nil
+    })
+}
+
+// AddVariants adds more variants to the Variants that were registered for
+// 'name' with RegisterVariants().  This lets several packages contribute
+// implementations of the same interface, which jsonface combines into one
+// CB.  If a tag is already used, it returns a *VariantConflictError, which
+// tells you where both variants were registered.
+//
+// If RegisterVariants() hasn't been called for 'name' yet, the variants are
+// held until it is, so it doesn't matter whether the plugins or the base
+// Variants are registered first.  (Until then, 'name' has no CB.)
+func (me *Registry) AddVariants(name TypeName, variants map[string]interface{}) error {
+    site:=callSite()
+    return me.update(func(s *registryState) error {
+        vs,has:=s.variants[name]
+        if !has {
+            if s.has(name) { return fmt.Errorf("the CB for %v is not a Variants",name) }
+            return s.addPending(name,variants,site)
+        }
+        for _,tag:=range sortedTags(variants) {
+            if _,has:=vs.types[tag]; has { return &VariantConflictError{Name:name, Tag:tag, First:s.tagSites[name][tag], Second:site} }
+        }
+        vs,e:=vs.With(variants); if e!=nil { return e }
+        tagSites:=map[string]string{}
+        for tag,site:=range s.tagSites[name] { tagSites[tag]=site }
+        for tag:=range variants { tagSites[tag]=site }
+        s.variants[name]=vs; s.tagSites[name]=tagSites
+        return nil
+    })
+}
+
+// addPending holds 'variants' until RegisterVariants() is called for 'name'.
+func (me *registryState) addPending(name TypeName, variants map[string]interface{}, site string) error {
+    old:=me.pending[name]
+    for _,tag:=range sortedTags(variants) {
+        if _,has:=old[tag]; has { return &VariantConflictError{Name:name, Tag:tag, First:me.tagSites[name][tag], Second:site} }
+    }
+    pending:=map[string]interface{}{}
+    tagSites:=map[string]string{}
+    for tag,x:=range old { pending[tag]=x; tagSites[tag]=me.tagSites[name][tag] }
+    for tag,x:=range variants { pending[tag]=x; tagSites[tag]=site }
+    e:=(&Variants{types:map[string]reflect.Type{}, tags:map[reflect.Type]string{}}).add(pending); if e!=nil { return e }  // Check for nil variants and reused types now, rather than later.
+    me.pending[name]=pending; me.tagSites[name]=tagSites
+    return nil
+}
+
+// RegisterType is like Register(), but the CB is keyed by the interface type
+// itself, rather than by a hand-written TypeName.  This avoids typos, which
+// would otherwise mean that the CB is silently never used.  't' must be an
+// interface type.  The CB is registered under the qualified TypeName, so it
+// can't collide with an interface from another package.
+//
+// Example:  err := registry.RegisterType(reflect.TypeOf((*Instrument)(nil)).Elem(), Instrument_UnmarshalJSON)
+func (me *Registry) RegisterType(t reflect.Type, cb CB) error {
+    name,e:=interfaceTypeName(t); if e!=nil { return e }
+    return me.Register(name,cb)
+}
+
+// Register adds a CB for the interface type 'I' to a Registry.  Unlike
+// Registry.Register(), you don't need to know the TypeName, and the compiler
+// guarantees that the CB returns something that implements 'I'.
+//
+// Example:
+//
+//     err := jsonface.Register(registry, func(bs []byte) (Instrument,error) {
+//         ...
+//     })
+func Register[I any](r *Registry, cb func([]byte) (I,error)) error {
+    return r.RegisterType(reflect.TypeOf((*I)(nil)).Elem(),func(bs []byte) (interface{},error) {
+        x,e:=cb(bs); if e!=nil { return nil,e }
+        return x,nil
+    })
+}
+
+// interfaceTypeName returns the TypeName of an interface type.
+func interfaceTypeName(t reflect.Type) (TypeName,error) {
+    if t==nil { return "",errors.New("nil type") }
+    if t.Kind()!=reflect.Interface { return "",fmt.Errorf("not an interface type: %v",t) }
+    return QualifiedTypeName(t),nil
+}
+
+// has reports whether the snapshot (not the parent) defines 'name'.
+func (me *registryState) has(name TypeName) bool {
+    _,hasCB:=me.cbs[name]; _,hasCtx:=me.ctxCBs[name]; _,hasVS:=me.variants[name]
+    return hasCB || hasCtx || hasVS
+}
+
+// Lookup returns the CB for 'name', and whether it was found.  If this
+// Registry doesn't define 'name', its parent is checked.
+func (me *Registry) Lookup(name TypeName) (CB,bool) {
+    for r:=me; r!=nil; r=r.parent {
+        s:=r.load()
+        cb,hasCB:=s.cbs[name]; ctxCB,hasCtx:=s.ctxCBs[name]; vs,hasVS:=s.variants[name]
+        if hasCB { return cb,true }
+        if hasCtx { return resolvedCB(me.contextCB(ctxCB)),true }
+        if hasVS { return me.variantsCB(vs),true }
+    }
+    return nil,false
+}
+
+// Unregister removes the CB for 'name' from this Registry (but not from its
+// parent).  It returns an error if this Registry doesn't define 'name'.
+func (me *Registry) Unregister(name TypeName) error {
+    return me.update(func(s *registryState) error {
+        _,hasPending:=s.pending[name]
+        if !s.has(name) && !hasPending { return fmt.Errorf("no CB defined: %v",name) }
+        delete(s.pending,name)
+        delete(s.cbs,name)
+        delete(s.ctxCBs,name)
+        delete(s.variants,name)
+        delete(s.sites,name)
+        delete(s.tagSites,name)
+        return nil
+    })
+}
+
+// Replace sets the CB for 'name' in this Registry, whether or not one was
+// already defined.  It returns the CB that this Registry previously defined
+// (or nil), so that you can restore it later.
+func (me *Registry) Replace(name TypeName, cb CB) (old CB, e error) {
+    site:=callSite()
+    e=me.update(func(s *registryState) error {
+        old=s.cbs[name]
+        if ctxCB,has:=s.ctxCBs[name]; has { old=resolvedCB(me.contextCB(ctxCB)) }
+        if vs,has:=s.variants[name]; has { old=me.variantsCB(vs) }
+        s.cbs[name]=cb; s.sites[name]=site
+        delete(s.pending,name)
+        delete(s.ctxCBs,name)
+        delete(s.variants,name)
+        delete(s.tagSites,name)
+        return nil
+    })
+    return old,e
+}
+
+// Freeze prevents any further changes to the Registry.  After Freeze(),
+// Register(), RegisterVariants(), Unregister(), and Replace() all return
+// ErrFrozen.  This protects you from packages that register CBs late (for
+// example, from a plugin's init() function), which would otherwise change the
+// decoding behavior of a running program.  A frozen Registry can still have
+// children, and they can still be changed.
+//
+// You will usually call Freeze() at the end of your program's initialization,
+// after checking the Registry with Validate().
+func (me *Registry) Freeze() {
+    me.mu.Lock(); defer me.mu.Unlock()
+    s:=*me.load(); s.frozen=true
+    me.state.Store(&s)
+}
+
+// Frozen reports whether Freeze() has been called.
+func (me *Registry) Frozen() bool { return me.load().frozen }
+
+// Validate checks the Registry against the destination types that you intend
+// to unmarshal into, to catch mistakes like misspelled TypeNames at startup
+// rather than while handling data.  It walks the given types (and the concrete
+// types of any Variants that it finds) the same way that unmarshalling does,
+// and reports:
+//
+//     * TypeNames that have a CB, but that never match an interface.
+//
+//     * Interfaces that are reachable from the types, but that have no CB.
+//       (Empty interfaces, like interface{}, are not reported since
+//       encoding/json can handle them by itself.)
+//
+//     * Short TypeNames that match more than one interface.  (See TypeName.)
+//
+// If there are any problems, the returned error is a *ValidationError.
+//
+// Example:  err := registry.Validate(reflect.TypeOf(Config{}), reflect.TypeOf([]Event(nil)))
+func (me *Registry) Validate(types ...reflect.Type) error {
+    cbs,vm:=me.merged()
+    used:=map[TypeName]reflect.Type{}
+    seen:=map[reflect.Type]bool{}
+    var missing,ambiguous []TypeName
+    var walk func(t reflect.Type)
+    walk=func(t reflect.Type) {
+        interfaceTypes(t,seen,func(it reflect.Type) {
+            name,has:=lookupName(cbs,it)
+            if !has {
+                if it.NumMethod()>0 { missing=append(missing,QualifiedTypeName(it)) }
+                return
+            }
+            if prev,has:=used[name]; has {
+                if prev!=it { ambiguous=append(ambiguous,name) }
+                return
+            }
+            used[name]=it
+            if vs,has:=vm[name]; has {
+                for _,tag:=range vs.order { walk(vs.types[tag]) }
+            }
+        })
+    }
+    for _,t:=range types {
+        if t==nil { return errors.New("nil type") }
+        walk(t)
+    }
+    var unused []TypeName
+    for name:=range cbs {
+        if _,has:=used[name]; !has { unused=append(unused,name) }
+    }
+    if len(unused)==0 && len(missing)==0 && len(ambiguous)==0 { return nil }
+    for _,names:=range [][]TypeName{unused,missing,ambiguous} {
+        sort.Slice(names,func(i,j int) bool { return names[i]<names[j] })
+    }
+    return &ValidationError{Unused:unused, Missing:missing, Ambiguous:ambiguous}
+}
+
+// Names returns the TypeNames that have a CB (including the ones inherited
+// from the parent), in sorted order.
+func (me *Registry) Names() []TypeName {
+    cbs,_:=me.merged()
+    names:=make([]TypeName,0,len(cbs))
+    for name:=range cbs { names=append(names,name) }
+    sort.Slice(names,func(i,j int) bool { return names[i]<names[j] })
+    return names
+}
+
+// CBMap returns a copy of the CBs in the Registry (including the ones
+// inherited from the parent).  This is useful for combining Registries, or
+// for passing to Unmarshal() or Compile().
+func (me *Registry) CBMap() CBMap {
+    cbs,_:=me.merged()
+    return cbs
+}
+
+// Unmarshal is like the Unmarshal() function, but it uses the CBs in the
+// Registry.  The Plans computed for each destination type are cached, so
+// repeated calls with the same type are cheap.  The cache is discarded
+// whenever the Registry (or its parent) changes.
+func (me *Registry) Unmarshal(bs []byte, destPtr interface{}) error {
+    return me.UnmarshalWithOptions(bs,destPtr,Options{})
+}
+
+// UnmarshalWithOptions is like Unmarshal(), but it lets you adjust the
+// behavior with Options.
+func (me *Registry) UnmarshalWithOptions(bs []byte, destPtr interface{}, opts Options) error {
+    destPtrV,e:=checkDestPtr(destPtr); if e!=nil { return e }
+    plan,e:=me.planCache().plan(destPtrV.Type().Elem()); if e!=nil { return e }
+    return plan.unmarshal(nil,bs,destPtrV,opts)
+}
+
+// UnmarshalContext is like Unmarshal(), but it stops early if 'ctx' is
+// canceled.  See the UnmarshalContext() function for details.
+func (me *Registry) UnmarshalContext(ctx context.Context, bs []byte, destPtr interface{}) error {
+    destPtrV,e:=checkDestPtr(destPtr); if e!=nil { return e }
+    plan,e:=me.planCache().plan(destPtrV.Type().Elem()); if e!=nil { return e }
+    return plan.unmarshal(ctx,bs,destPtrV,Options{})
+}
+
+// UnmarshalWith is like Unmarshal(), but the CBs in 'overlay' take precedence
+// over the Registry's CBs for this one call.  It is useful for per-request
+// customization, like "the usual CBs, but with a different Shape CB for this
+// tenant".  The overlay is also used for nested interfaces within Variants.
+//
+// The Plans for an overlay can't be cached, so if you use the same overlay
+// many times, create a child Registry with NewChild() instead.
+func (me *Registry) UnmarshalWith(bs []byte, destPtr interface{}, overlay CBMap) error {
+    child:=me.NewChild()
+    s:=child.load()
+    for k,v:=range overlay { s.cbs[k]=v }  // The child isn't shared yet, so we can modify its snapshot directly.
+    return child.Unmarshal(bs,destPtr)
+}
+
+// NewDecoder returns a Decoder that reads from r and uses the CBs in the
+// Registry.  The Decoder gets a copy of the CBs, so changes to the Registry
+// don't affect Decoders that already exist.
+func (me *Registry) NewDecoder(r io.Reader) *Decoder {
+    return &Decoder{dec:json.NewDecoder(r), plans:me.planCache()}  // The planCache is never changed, so it can be shared.
+}
+
+// Marshal is like the Marshal() function, but it uses the Variants that were
+// added with RegisterVariants().
+func (me *Registry) Marshal(v interface{}) ([]byte,error) { return Marshal(v,me.variantsMap()) }
+
+// MarshalIndent is like Marshal(), but it indents the output like json.MarshalIndent().
+func (me *Registry) MarshalIndent(v interface{}, prefix, indent string) ([]byte,error) {
+    return MarshalIndent(v,prefix,indent,me.variantsMap())
+}
+
+// variantsMap returns all the Variants that are visible from this Registry.
+func (me *Registry) variantsMap() VariantsMap {
+    _,vm:=me.merged()
+    return vm
+}
+
+// variantsCB returns a CB for 'vs' that unmarshals nested interfaces with 'me'.
+func (me *Registry) variantsCB(vs *Variants) CB {
+    return func(bs []byte) (interface{},error) { return vs.unmarshal(bs,me.Unmarshal) }
+}
+
+// merged returns copies of all the CBs and Variants that are visible from this
+// Registry, with children taking precedence over their parents.
+func (me *Registry) merged() (CBMap,VariantsMap) {
+    cbs,_,vm:=me.mergedFor(me)
+    return cbs,vm
+}
+
+// mergedFor is the implementation of merged().  The CBs that need a
+// DecodeContext (including the ones for Variants) are also returned
+// separately, so that Plans can call them directly.  The plain versions of
+// those CBs use 'top' to unmarshal nested interfaces.
+func (me *Registry) mergedFor(top *Registry) (CBMap,map[TypeName]ContextCB,VariantsMap) {
+    cbs,ctxCBs,vm:=CBMap{},map[TypeName]ContextCB{},VariantsMap{}
+    if me.parent!=nil { cbs,ctxCBs,vm=me.parent.mergedFor(top) }
+    s:=me.load()
+    for name,cb:=range s.cbs { cbs[name]=cb; delete(ctxCBs,name); delete(vm,name) }
+    for name,cb:=range s.ctxCBs { cbs[name]=top.contextCB(cb); ctxCBs[name]=cb; delete(vm,name) }
+    for name,vs:=range s.variants { cbs[name]=top.variantsCB(vs); ctxCBs[name]=variantsContextCB(vs); vm[name]=vs }
+    return cbs,ctxCBs,vm
+}
+
+// generation changes whenever this Registry or any of its parents change.
+func (me *Registry) generation() uint64 {
+    gen:=me.load().gen
+    if me.parent!=nil { gen+=me.parent.generation() }
+    return gen
+}
+
+// planCache returns the Plans for the current CBs, rebuilding them if anything
+// has changed since they were built.  The planCache has its own copy of the
+// CBs, so later changes to the Registry don't affect unmarshalling that is
+// already in progress.  If two goroutines rebuild the Plans at the same time,
+// one of the results is simply discarded.
+func (me *Registry) planCache() *planCache {
+    gen:=me.generation()
+    if p,_:=me.plans.Load().(*registryPlans); p!=nil && p.gen==gen { return p.plans }
+    cbs,ctxCBs,_:=me.mergedFor(me)
+    plans:=newPlanCache(cbs)
+    plans.ctxCBs=ctxCBs; plans.reg=me
+    me.plans.Store(&registryPlans{plans,gen})
+    return plans
+}
+
+// A RegistrySnapshot is a saved copy of the contents of a Registry.  See
+// Registry.Snapshot().
+type RegistrySnapshot struct {
+    state *registryState
+}
+
+// Snapshot saves the current contents of the Registry (not including its
+// parent), so that they can be put back later with Restore().  This is mainly
+// useful for tests; see the jsonfacetest package.  Snapshots are cheap, since
+// the contents of a Registry are never modified in place.
+func (me *Registry) Snapshot() RegistrySnapshot { return RegistrySnapshot{me.load()} }
+
+// Restore replaces the contents of the Registry with a RegistrySnapshot.  It
+// also restores whether the Registry was frozen, so it works even after
+// Freeze().  The zero RegistrySnapshot restores an empty Registry.
+func (me *Registry) Restore(snap RegistrySnapshot) {
+    me.mu.Lock(); defer me.mu.Unlock()
+    gen:=me.load().gen+1
+    s:=newRegistryState(gen)
+    if snap.state!=nil { *s=*snap.state; s.gen=gen }  // The generation must keep increasing, so that cached Plans are discarded.
+    me.state.Store(s)
+}
+
+// reset removes everything from the Registry, and unfreezes it.
+func (me *Registry) reset() { me.Restore(RegistrySnapshot{}) }
@@ -0,0 +1,325 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "errors"
+    "reflect"
+    "runtime"
+    "strings"
+)
+
+func TestRegistry(t *testing.T) {
+    r:=NewRegistry()
+    var st struct { I I; J J }
+    e:=r.Unmarshal([]byte(`{"I":1}`),&st); if e==nil { panic("expected error") }  // No CB for I yet.
+
+    e=r.Register("jsonface.I",cbs["jsonface.I"]); if e!=nil { panic(e) }
+    e=r.Register("jsonface.I",cbs["jsonface.I"]); if e==nil || !strings.HasPrefix(e.Error(),"CB already defined: jsonface.I (first registered at ") { panic(e) }
+    e=r.Unmarshal([]byte(`{"I":1}`),&st); if fmt.Sprintf("%v %v",st.I,e)!=`(1) <nil>` { panic(fmt.Sprintf("%v %v",st.I,e)) }
+
+    old,e:=r.Replace("jsonface.I",func(bs []byte)(interface{},error){ return IImpl("new"),nil })
+    if old==nil || e!=nil { panic("expected old CB") }
+    e=r.Unmarshal([]byte(`{"I":1}`),&st); if fmt.Sprintf("%v %v",st.I,e)!=`new <nil>` { panic(fmt.Sprintf("%v %v",st.I,e)) }  // The Plan cache was discarded.
+    _,has:=r.Lookup("jsonface.I"); if !has { panic("Lookup failed") }
+    _,has=r.Lookup("jsonface.J"); if has { panic("Lookup found J") }
+
+    vs,e:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{} }); if e!=nil { panic(e) }
+    e=r.RegisterVariants("jsonface.I",vs); if e==nil { panic("expected error") }
+    if r.Unregister("jsonface.I")!=nil || r.Unregister("jsonface.I")==nil { panic("Unregister") }
+    e=r.RegisterVariants("jsonface.I",vs); if e!=nil { panic(e) }
+    if fmt.Sprint(r.Names())!="[jsonface.I]" || len(r.CBMap())!=1 { panic(r.Names()) }
+
+    // Nested interfaces use the same Registry, and Marshal uses the Variants:
+    var is []I
+    e=r.Unmarshal([]byte(`[{"Type":"B","Kid":{"Type":"A","N":2}}]`),&is); if fmt.Sprintf("%#v %v",is,e)!=`[]jsonface.I{jsonface.VB{S:"", Kid:jsonface.VA{N:2}}} <nil>` { panic(fmt.Sprintf("%#v %v",is,e)) }
+    bs,e:=r.Marshal(is); if string(bs)!=`[{"Type":"B","S":"","Kid":{"Type":"A","N":2}}]` { panic(fmt.Sprint(string(bs),e)) }
+
+    // A Decoder gets a copy of the CBs:
+    dec:=r.NewDecoder(strings.NewReader(`{"Type":"A","N":3} {"Type":"A","N":4}`))
+    var i I
+    e=dec.Decode(&i); if fmt.Sprintf("%v %v",i,e)!=`{3} <nil>` { panic(fmt.Sprintf("%v %v",i,e)) }
+    r.Unregister("jsonface.I")
+    e=dec.Decode(&i); if fmt.Sprintf("%v %v",i,e)!=`{4} <nil>` { panic(fmt.Sprintf("%v %v",i,e)) }
+
+    // Registries are independent of each other and of the global registry:
+    r2:=NewRegistry()
+    if len(r2.Names())!=0 || len(r.Names())!=0 { panic("not independent") }
+
+    // Concurrent use:
+    var wg sync.WaitGroup
+    for n:=0;n<8;n++ {
+        wg.Add(1)
+        go func(n int) {
+            defer wg.Done()
+            name:=TypeName(fmt.Sprintf("x.T%d",n))
+            r2.Register(name,cbs["jsonface.I"])
+            r2.Register("jsonface.I",cbs["jsonface.I"])
+            var is []I
+            r2.Unmarshal([]byte(`[1,2]`),&is)
+            r2.Names()
+            r2.Unregister(name)
+        }(n)
+    }
+    wg.Wait()
+    if fmt.Sprint(r2.Names())!="[jsonface.I]" { panic(r2.Names()) }
+}
+
+func TestRegistryChild(t *testing.T) {
+    parent:=NewRegistry()
+    vs,e:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{} }); if e!=nil { panic(e) }
+    e=parent.RegisterVariants("jsonface.I",vs); if e!=nil { panic(e) }
+    child:=parent.NewChild()
+    if child.Parent()!=parent || parent.Parent()!=nil { panic("Parent") }
+
+    // Lookups fall back to the parent:
+    _,has:=child.Lookup("jsonface.I"); if !has { panic("Lookup failed") }
+    var is []I
+    e=child.Unmarshal([]byte(`[{"Type":"A","N":1}]`),&is); if fmt.Sprint(is,e)!=`[{1}] <nil>` { panic(fmt.Sprint(is,e)) }
+
+    // The child can override the parent without affecting it:
+    e=child.Register("jsonface.I",cbs["jsonface.I"]); if e!=nil { panic(e) }
+    e=child.Unmarshal([]byte(`[{"Type":"A","N":1}]`),&is); if fmt.Sprintf("%v %v",is,e)!=`[({"Type":"A","N":1})] <nil>` { panic(fmt.Sprintf("%v %v",is,e)) }
+    e=parent.Unmarshal([]byte(`[{"Type":"A","N":1}]`),&is); if fmt.Sprint(is,e)!=`[{1}] <nil>` { panic(fmt.Sprint(is,e)) }
+    bs,e:=child.Marshal([]I{VA{2}}); if string(bs)!=`[{"N":2}]` { panic(fmt.Sprint(string(bs),e)) }  // The child's CB is not a Variants.
+    child.Unregister("jsonface.I")
+    bs,e=child.Marshal([]I{VA{2}}); if string(bs)!=`[{"Type":"A","N":2}]` { panic(fmt.Sprint(string(bs),e)) }
+
+    // Changes to the parent are seen by the child:
+    e=parent.Register("jsonface.J",func(bs []byte)(interface{},error){ return nil,nil }); if e!=nil { panic(e) }
+    if fmt.Sprint(child.Names())!="[jsonface.I jsonface.J]" { panic(child.Names()) }
+    parent.Unregister("jsonface.I")
+    e=child.Unmarshal([]byte(`[{"Type":"A","N":1}]`),&is); if e==nil { panic("expected error") }
+    parent.RegisterVariants("jsonface.I",vs)
+
+    // Overlays apply to one call, including interfaces nested inside Variants:
+    js,e:=NewVariants("Type",map[string]interface{}{ "R":RJ{} }); if e!=nil { panic(e) }
+    e=parent.RegisterVariants("jsonface.J",js); if e==nil { panic("expected error") }
+    parent.Unregister("jsonface.J")
+    e=parent.RegisterVariants("jsonface.J",js); if e!=nil { panic(e) }
+    data:=[]byte(`[{"Type":"R","Sub":{"Type":"A","N":3}}]`)
+    var jjs []J
+    e=parent.UnmarshalWith(data,&jjs,CBMap{ "jsonface.I":cbs["jsonface.I"] }); if fmt.Sprintf("%v %v",jjs,e)!=`[{({"Type":"A","N":3})}] <nil>` { panic(fmt.Sprintf("%v %v",jjs,e)) }
+    e=parent.Unmarshal(data,&jjs); if fmt.Sprint(jjs,e)!=`[{{3}}] <nil>` { panic(fmt.Sprint(jjs,e)) }
+}
+
+type RJ struct { Sub I }
+func (me RJ) G() {}
+
+func TestRegistryReentrant(t *testing.T) {
+    // A CB that unmarshals recursively while another goroutine is waiting to
+    // register a CB.  This would deadlock if unmarshalling held a lock.
+    r:=NewRegistry()
+    entered,registered:=make(chan bool),make(chan bool)
+    var first int32
+    r.Register("jsonface.I",func(bs []byte)(interface{},error){
+        if string(bs)!="0" {
+            var i I
+            e:=r.Unmarshal([]byte("0"),&i); if e!=nil { return nil,e }
+            return i,nil
+        }
+        if atomic.CompareAndSwapInt32(&first,0,1) { entered<-true; <-registered }
+        return IImpl("zero"),nil
+    })
+    go func() {
+        <-entered
+        e:=r.Register("jsonface.J",func(bs []byte)(interface{},error){ return nil,nil }); if e!=nil { panic(e) }
+        var i I
+        e=r.Unmarshal([]byte("0"),&i); if e!=nil { panic(e) }  // Unmarshalling from another goroutine works too.
+        registered<-true
+    }()
+    var i I
+    e:=r.Unmarshal([]byte("1"),&i); if fmt.Sprintf("%v %v",i,e)!="zero <nil>" { panic(fmt.Sprintf("%v %v",i,e)) }
+    if fmt.Sprint(r.Names())!="[jsonface.I jsonface.J]" { panic(r.Names()) }
+
+    // CBs can even register more CBs:
+    r.Replace("jsonface.I",func(bs []byte)(interface{},error){ return IImpl(bs),r.Register(TypeName("x."+string(bs)),nil) })
+    var is []I
+    e=r.Unmarshal([]byte(`["a","b"]`),&is); if e!=nil || fmt.Sprint(r.Names())!="[jsonface.I jsonface.J x.\"a\" x.\"b\"]" { panic(fmt.Sprint(r.Names(),e)) }
+}
+
+func TestRegistryFreeze(t *testing.T) {
+    r:=NewRegistry()
+    e:=r.Register("jsonface.I",cbs["jsonface.I"]); if e!=nil { panic(e) }
+    if r.Frozen() { panic("Frozen") }
+    r.Freeze()
+    if !r.Frozen() { panic("not Frozen") }
+    e=r.Register("jsonface.J",cbs["jsonface.I"]); if !errors.Is(e,ErrFrozen) { panic(e) }
+    vs,_:=NewVariants("Type",map[string]interface{}{ "A":VA{} })
+    e=r.RegisterVariants("jsonface.J",vs); if !errors.Is(e,ErrFrozen) { panic(e) }
+    e=r.Unregister("jsonface.I"); if !errors.Is(e,ErrFrozen) { panic(e) }
+    _,e=r.Replace("jsonface.I",nil); if !errors.Is(e,ErrFrozen) { panic(e) }
+    if fmt.Sprint(r.Names())!="[jsonface.I]" { panic(r.Names()) }
+    var i I
+    e=r.Unmarshal([]byte("1"),&i); if fmt.Sprintf("%v %v",i,e)!="(1) <nil>" { panic(fmt.Sprintf("%v %v",i,e)) }
+
+    // Children of a frozen Registry can still be changed:
+    e=r.NewChild().Register("jsonface.I",cbs["jsonface.I"]); if e!=nil { panic(e) }
+
+    r.reset()
+    if r.Frozen() { panic("reset didn't unfreeze") }
+}
+
+type (
+    ValidA struct { Is []I; M map[string]*J; E interface{}; U UnmarshalsItself }
+    ValidB struct { Err error }
+    UnmarshalsItself struct { I I }
+)
+func (me *UnmarshalsItself) UnmarshalJSON([]byte) error { return nil }
+
+func TestRegistryValidate(t *testing.T) {
+    r:=NewRegistry()
+    r.Register("jsonface.I",cbs["jsonface.I"])
+    r.Register("jsonface.J",cbs["jsonface.I"])
+    e:=r.Validate(reflect.TypeOf(ValidA{})); if e!=nil { panic(e) }
+    e=r.Validate(reflect.TypeOf(ValidB{}),reflect.TypeOf([]I(nil)))
+    var ve *ValidationError
+    if !errors.As(e,&ve) || fmt.Sprint(ve.Unused,ve.Missing)!="[jsonface.J] [error]" { panic(e) }
+    if e.Error()!="jsonface: invalid registry: unused CBs: [jsonface.J]; interfaces without CBs: [error]" { panic(e) }
+    e=r.Validate(nil); if e==nil { panic("expected error") }
+
+    // Interfaces inside of Variants are found too:
+    r=NewRegistry()
+    vs,_:=NewVariants("Type",map[string]interface{}{ "R":RJ{} })
+    r.RegisterVariants("jsonface.J",vs)
+    e=r.Validate(reflect.TypeOf([]J(nil))); if !errors.As(e,&ve) || fmt.Sprint(ve.Unused,ve.Missing)!="[] [jsonface.I]" { panic(e) }
+    child:=r.NewChild()
+    child.Register("jsonface.I",cbs["jsonface.I"])
+    e=child.Validate(reflect.TypeOf([]J(nil))); if e!=nil { panic(e) }
+}
+
+func TestRegisterType(t *testing.T) {
+    r:=NewRegistry()
+    e:=Register(r,func(bs []byte) (I,error) {
+        if string(bs)=="0" { return nil,nil }
+        return IImpl(bs),nil
+    }); if e!=nil { panic(e) }
+    if fmt.Sprint(r.Names())!="[jsonface.I]" { panic(r.Names()) }
+    var is []I
+    e=r.Unmarshal([]byte(`[1,0]`),&is); if fmt.Sprintf("%#v %v",is,e)!=`[]jsonface.I{"1", jsonface.I(nil)} <nil>` { panic(fmt.Sprintf("%#v %v",is,e)) }
+    e=Register(r,func(bs []byte) (I,error) { return nil,nil }); if e==nil { panic("expected error") }
+
+    e=r.RegisterType(reflect.TypeOf((*J)(nil)).Elem(),cbs["jsonface.I"]); if e!=nil { panic(e) }
+    if fmt.Sprint(r.Names())!="[jsonface.I jsonface.J]" { panic(r.Names()) }
+    e=r.RegisterType(reflect.TypeOf(IImpl("")),cbs["jsonface.I"]); if fmt.Sprint(e)!="not an interface type: jsonface.IImpl" { panic(e) }
+    e=Register(r,func(bs []byte) (IImpl,error) { return "",nil }); if fmt.Sprint(e)!="not an interface type: jsonface.IImpl" { panic(e) }
+    e=r.RegisterType(nil,nil); if e==nil { panic("expected error") }
+}
+
+func TestDuplicateCBError(t *testing.T) {
+    here:=func() string { _,file,line,_:=runtime.Caller(1); return fmt.Sprintf("%v:%v",file,line) }
+    r:=NewRegistry()
+    var de *DuplicateCBError
+    first:=here(); e:=Register(r,func(bs []byte) (I,error) { return nil,nil }); if e!=nil { panic(e) }
+    second:=here(); e=r.Register("jsonface.I",nil)
+    if !errors.As(e,&de) || de.Name!="jsonface.I" || de.First!=first || de.Second!=second { panic(fmt.Sprintf("%#v",e)) }
+    if e.Error()!=fmt.Sprintf("CB already defined: jsonface.I (first registered at %v, registered again at %v)",first,second) { panic(e) }
+
+    vs,_:=NewVariants("Type",map[string]interface{}{ "A":VA{} })
+    second=here(); e=r.RegisterVariants("jsonface.I",vs); if !errors.As(e,&de) || de.First!=first || de.Second!=second { panic(fmt.Sprintf("%#v",e)) }
+    second=here(); e=r.RegisterType(reflect.TypeOf((*I)(nil)).Elem(),nil); if !errors.As(e,&de) || de.First!=first || de.Second!=second { panic(fmt.Sprintf("%#v",e)) }
+
+    // Replace() moves the registration site:
+    first=here(); r.Replace("jsonface.I",nil)
+    e=r.Register("jsonface.I",nil); if !errors.As(e,&de) || de.First!=first { panic(fmt.Sprintf("%#v",e)) }
+    r.Unregister("jsonface.I")
+    first=here(); e=r.RegisterVariants("jsonface.I",vs); if e!=nil { panic(e) }
+    e=r.Register("jsonface.I",nil); if !errors.As(e,&de) || de.First!=first { panic(fmt.Sprintf("%#v",e)) }
+}
+
+func TestRegistryAddVariantsFirst(t *testing.T) {
+    here:=func() string { _,file,line,_:=runtime.Caller(1); return fmt.Sprintf("%v:%v",file,line) }
+    r:=NewRegistry()
+
+    // The plugins can add their variants before the base Variants is registered:
+    first:=here(); e:=r.AddVariants("jsonface.I",map[string]interface{}{ "A":VA{} }); if e!=nil { panic(e) }
+    bSite:=here(); e=r.AddVariants("jsonface.I",map[string]interface{}{ "B":VB{} }); if e!=nil { panic(e) }
+    var vce *VariantConflictError
+    second:=here(); e=r.AddVariants("jsonface.I",map[string]interface{}{ "A":&VPtr{} })
+    if !errors.As(e,&vce) || vce.First!=first || vce.Second!=second { panic(fmt.Sprintf("%#v",e)) }
+    e=r.AddVariants("jsonface.I",map[string]interface{}{ "C":VA{} }); if e==nil || !strings.Contains(e.Error(),"jsonface.VA is used for both") { panic(e) }
+    _,has:=r.Lookup("jsonface.I"); if has { panic("pending variants have a CB") }
+
+    vs,_:=NewVariants("Type",map[string]interface{}{ "P":&VPtr{} })
+    e=r.RegisterVariants("jsonface.I",vs); if e!=nil { panic(e) }
+    var is []I
+    e=r.Unmarshal([]byte(`[{"Type":"A","N":1},{"Type":"B","Kid":{"Type":"P","X":2}}]`),&is)
+    if e!=nil || fmt.Sprint(is[0])!="{1}" || *is[1].(VB).Kid.(*VPtr)!=(VPtr{2}) { panic(fmt.Sprint(is,e)) }
+    if len(vs.order)!=1 { panic("original Variants was modified") }
+    third:=here(); e=r.AddVariants("jsonface.I",map[string]interface{}{ "B":&VPtr{} })
+    if !errors.As(e,&vce) || vce.First!=bSite || vce.Second!=third { panic(fmt.Sprintf("%#v",e)) }  // The pending sites are kept.
+
+    // A conflict with the base Variants is reported by RegisterVariants():
+    r2:=NewRegistry()
+    first=here(); r2.AddVariants("jsonface.I",map[string]interface{}{ "P":VA{} })
+    second=here(); e=r2.RegisterVariants("jsonface.I",vs)
+    if !errors.As(e,&vce) || vce.Tag!="P" || vce.First!=first || vce.Second!=second { panic(fmt.Sprintf("%#v",e)) }
+
+    // Unregister() and Replace() discard pending variants:
+    if r2.Unregister("jsonface.I")!=nil || r2.Unregister("jsonface.I")==nil { panic("Unregister") }
+    r2.AddVariants("jsonface.I",map[string]interface{}{ "P":VA{} })
+    r2.Replace("jsonface.I",cbs["jsonface.I"])
+    r2.Unregister("jsonface.I")
+    e=r2.RegisterVariants("jsonface.I",vs); if e!=nil { panic(e) }
+}
+
+func TestRegistryAddVariants(t *testing.T) {
+    here:=func() string { _,file,line,_:=runtime.Caller(1); return fmt.Sprintf("%v:%v",file,line) }
+    r:=NewRegistry()
+    r.Register("jsonface.I",cbs["jsonface.I"])
+    e:=r.AddVariants("jsonface.I",map[string]interface{}{ "A":VA{} }); if fmt.Sprint(e)!="the CB for jsonface.I is not a Variants" { panic(e) }
+    r.Unregister("jsonface.I")
+    vs,_:=NewVariants("Type",map[string]interface{}{})
+    first:=here(); e=r.RegisterVariants("jsonface.I",vs); if e!=nil { panic(e) }
+
+    // Each "package" contributes its own variants:
+    second:=here(); e=r.AddVariants("jsonface.I",map[string]interface{}{ "A":VA{} }); if e!=nil { panic(e) }
+    e=r.AddVariants("jsonface.I",map[string]interface{}{ "B":VB{} }); if e!=nil { panic(e) }
+    var is []I
+    e=r.Unmarshal([]byte(`[{"Type":"A","N":1},{"Type":"B","Kid":{"Type":"A","N":2}}]`),&is); if fmt.Sprint(is,e)!="[{1} { {2}}] <nil>" { panic(fmt.Sprint(is,e)) }
+    bs,e:=r.Marshal(is); if string(bs)!=`[{"Type":"A","N":1},{"Type":"B","S":"","Kid":{"Type":"A","N":2}}]` { panic(fmt.Sprint(string(bs),e)) }
+    if vs.order!=nil { panic("original Variants was modified") }
+
+    // Conflicting tags are reported with both call sites:
+    var vce *VariantConflictError
+    third:=here(); e=r.AddVariants("jsonface.I",map[string]interface{}{ "A":&VPtr{} })
+    if !errors.As(e,&vce) || vce.Name!="jsonface.I" || vce.Tag!="A" || vce.First!=second || vce.Second!=third { panic(fmt.Sprintf("%#v",e)) }
+    if e.Error()!=fmt.Sprintf(`variant "A" of jsonface.I already defined (first registered at %v, registered again at %v)`,second,third) { panic(e) }
+    vs,_=NewVariants("Type",map[string]interface{}{ "R":VA{} })
+    r2:=NewRegistry()
+    first=here(); r2.RegisterVariants("jsonface.I",vs)
+    e=r2.AddVariants("jsonface.I",map[string]interface{}{ "R":VB{} }); if !errors.As(e,&vce) || vce.First!=first { panic(fmt.Sprintf("%#v",e)) }
+    e=r2.AddVariants("jsonface.I",map[string]interface{}{ "A":VA{} }); if e==nil || errors.As(e,&vce) { panic(e) }  // The same type with two tags.
+
+    // Failed additions don't change anything:
+    e=r.Unmarshal([]byte(`[{"Type":"P","X":1}]`),&is); if !errors.Is(e,ErrUnknownVariant) { panic(e) }
+    r.Freeze()
+    e=r.AddVariants("jsonface.I",map[string]interface{}{ "P":&VPtr{} }); if !errors.Is(e,ErrFrozen) { panic(e) }
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+    r:=NewRegistry()
+    r.Register("jsonface.I",cbs["jsonface.I"])
+    snap:=r.Snapshot()
+    r.Replace("jsonface.I",func(bs []byte)(interface{},error){ return IImpl("new"),nil })
+    r.Register("jsonface.J",nil)
+    r.Freeze()
+    var i I
+    r.Unmarshal([]byte("1"),&i)  // Cache a Plan.
+    r.Restore(snap)
+    if r.Frozen() || fmt.Sprint(r.Names())!="[jsonface.I]" { panic(r.Names()) }
+    e:=r.Unmarshal([]byte("1"),&i); if fmt.Sprintf("%v %v",i,e)!="(1) <nil>" { panic(fmt.Sprintf("%v %v",i,e)) }
+    r.Restore(RegistrySnapshot{})
+    if len(r.Names())!=0 { panic(r.Names()) }
+}
+
+func TestUnmarshalAs(t *testing.T) {
+    r:=NewRegistry()
+    r.Register("jsonface.I",cbs["jsonface.I"])
+    is,e:=UnmarshalAs[[]I]([]byte(`[1,"2"]`),r); if fmt.Sprintf("%v %v",is,e)!=`[(1) ("2")] <nil>` { panic(fmt.Sprintf("%v %v",is,e)) }
+    n,e:=UnmarshalAs[int]([]byte(`5`),r); if n!=5 || e!=nil { panic(fmt.Sprint(n,e)) }
+    _,e=UnmarshalAs[[]I]([]byte(`{}`),r); if e==nil { panic("expected error") }
+    _,e=UnmarshalAs[struct{ K interface{ K() } }]([]byte(`{"K":1}`),nil); if e==nil { panic("expected error") }  // nil means the global registry.
+}
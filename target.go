@@ -0,0 +1,102 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "reflect"
+)
+
+// A TargetCB is a simpler kind of CB.  Instead of unmarshalling the value
+// itself, it only chooses the concrete type, by returning a pointer to a new,
+// empty value.  jsonface then unmarshals the data into it, using the same CBs,
+// so interfaces nested inside the concrete type are handled automatically
+// (and consistently with the rest of the document).  Register it with
+// Registry.RegisterTarget(), or use its CB() method with a CBMap.
+//
+// Example:
+//
+//     func Animal_Target(bs []byte) (interface{},error) {
+//         kind,err := jsonface.RawValue(bs).FieldString("Kind")
+//         if err!=nil { return nil,err }
+//         switch kind {
+//         case "cow": return &Cow{}, nil
+//         case "pig": return &Pig{}, nil
+//         default: return nil, fmt.Errorf("unknown animal: %q", kind)
+//         }
+//     }
+//
+// The interface receives the populated value (Cow), unless only a pointer to
+// it implements the interface, in which case it receives the pointer (*Cow).
+// If the TargetCB returns nil (without an error), the interface is set to nil.
+// (If you call the CB from Registry.Lookup() yourself, the interface type isn't
+// known, so you always get the pointer.)
+type TargetCB func(bs []byte) (target interface{}, err error)
+
+// RegisterTarget adds a TargetCB to the Registry, like Register().
+func (me *Registry) RegisterTarget(name TypeName, cb TargetCB) error {
+    site:=callSite()
+    return me.update(func(s *registryState) error {
+        if s.has(name) { return &DuplicateCBError{Name:name, First:s.sites[name], Second:site} }
+        s.ctxCBs[name]=targetContextCB(cb); s.sites[name]=site
+        return nil
+    })
+}
+
+// AddGlobalTargetCB is like AddGlobalCB(), but for a TargetCB.
+func AddGlobalTargetCB(name TypeName, cb TargetCB) {
+    e:=globalRegistry.RegisterTarget(name,cb); if e!=nil { panic(e) }
+}
+
+// CB returns a plain CB for the TargetCB, for use with Unmarshal() and a
+// CBMap.  The targets are populated using 'cbs', which will usually be the
+// CBMap that you add the returned CB to, like Variants.CB():
+//
+//     cbs := jsonface.CBMap{}
+//     cbs["main.Animal"] = jsonface.TargetCB(Animal_Target).CB(cbs)
+func (me TargetCB) CB(cbs CBMap) CB {
+    return func(bs []byte) (interface{},error) {
+        return me.populate(bs,nil,func(bs []byte, destPtr interface{}) error { return Unmarshal(bs,destPtr,cbs) })
+    }
+}
+
+// targetResult is the result of a TargetCB when the interface type isn't known
+// yet (in the plain CB from CB(), or from Registry.CBMap()).  decodeRaw
+// resolves it when it stores the value, so that the result is the same as
+// when the type is known.
+type targetResult struct { ptr reflect.Value }
+
+// resolve returns the value to store in an interface of type 't'.  If 't' is
+// nil, the pointer is returned.
+func (me targetResult) resolve(t reflect.Type) interface{} {
+    if t==nil || !me.ptr.Elem().Type().AssignableTo(t) { return me.ptr.Interface() }  // Only the pointer implements the interface.
+    return me.ptr.Elem().Interface()
+}
+
+// resolvedCB wraps a CB that might return a targetResult, for callers other
+// than decodeRaw.
+func resolvedCB(cb CB) CB {
+    return func(bs []byte) (interface{},error) {
+        x,e:=cb(bs)
+        if tr,ok:=x.(targetResult); ok { x=tr.resolve(nil) }
+        return x,e
+    }
+}
+
+// targetContextCB returns a ContextCB that populates the targets of 'cb'.
+func targetContextCB(cb TargetCB) ContextCB {
+    return func(ctx *DecodeContext, bs []byte) (interface{},error) { return cb.populate(bs,ctx.Type,ctx.Unmarshal) }
+}
+
+// populate gets a target from the TargetCB and uses 'unmarshal' to fill it.
+// 't' is the interface type, or nil if it isn't known.
+func (me TargetCB) populate(bs []byte, t reflect.Type, unmarshal func([]byte,interface{}) error) (interface{},error) {
+    target,e:=me(bs); if e!=nil || target==nil { return nil,e }
+    ptr:=reflect.ValueOf(target)
+    if ptr.Kind()!=reflect.Ptr || ptr.IsNil() { return nil,fmt.Errorf("TargetCB must return a non-nil pointer, not %T",target) }
+    e=unmarshal(bs,target); if e!=nil { return nil,e }
+    if t==nil { return targetResult{ptr},nil }
+    return targetResult{ptr}.resolve(t),nil
+}
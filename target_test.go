@@ -0,0 +1,87 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "errors"
+    "strings"
+)
+
+type TNest struct { Kids []I }
+func (me TNest) F() {}
+
+func TestTargetCB(t *testing.T) {
+    r:=NewRegistry()
+    e:=r.RegisterTarget("jsonface.I",func(bs []byte) (interface{},error) {
+        kind,e:=RawValue(bs).FieldString("Kind"); if e!=nil { return nil,e }
+        switch kind {
+        case "a": return &VA{},nil
+        case "p": return &VPtr{},nil
+        case "n": return &TNest{},nil
+        case "": return nil,nil
+        case "bad": return VA{},nil
+        default: return nil,fmt.Errorf("unknown kind: %q",kind)
+        }
+    }); if e!=nil { panic(e) }
+    e=r.RegisterTarget("jsonface.I",nil); if e==nil || !strings.HasPrefix(e.Error(),"CB already defined: jsonface.I") { panic(e) }
+
+    // Values are used if they implement the interface, otherwise pointers:
+    var is []I
+    e=r.Unmarshal([]byte(`[{"Kind":"a","N":1},{"Kind":"p","X":2},{}]`),&is)
+    if e!=nil || len(is)!=3 || is[0]!=(VA{1}) || *is[1].(*VPtr)!=(VPtr{2}) || is[2]!=nil { panic(fmt.Sprintf("%#v %v",is,e)) }
+
+    // Nested interfaces are unmarshalled with the same CBs, and errors point to the right place:
+    var i I
+    e=r.Unmarshal([]byte(`{"Kind":"n","Kids":[{"Kind":"a","N":3},{"Kind":"n","Kids":[{"Kind":"p","X":4}]}]}`),&i)
+    if e!=nil || fmt.Sprint(i.(TNest).Kids[0],*i.(TNest).Kids[1].(TNest).Kids[0].(*VPtr))!="{3} {4}" { panic(fmt.Sprint(i,e)) }
+    e=r.Unmarshal([]byte(`{"Kind":"n","Kids":[{"Kind":"a"},{"Kind":"x"}]}`),&i)
+    var de *DecodeError
+    if !errors.As(e,&de) || de.Path!="/Kids/1" || !strings.Contains(e.Error(),`unknown kind: "x"`) { panic(e) }
+    e=r.Unmarshal([]byte(`{"Kind":"bad"}`),&i); if e==nil || !strings.Contains(e.Error(),"TargetCB must return a non-nil pointer, not jsonface.VA") { panic(e) }
+
+    // Through a plain CB, the interface type isn't known, but the results are the same:
+    e=Unmarshal([]byte(`[{"Kind":"a","N":7},{"Kind":"p","X":8}]`),&is,r.CBMap())
+    if e!=nil || len(is)!=2 || is[0]!=(VA{7}) || *is[1].(*VPtr)!=(VPtr{8}) { panic(fmt.Sprintf("%#v %v",is,e)) }
+    cb,_:=r.Lookup("jsonface.I")
+    x,e:=cb([]byte(`{"Kind":"p","X":9}`)); if e!=nil || *x.(*VPtr)!=(VPtr{9}) { panic(fmt.Sprintf("%#v %v",x,e)) }
+    x,e=cb([]byte(`{"Kind":"a","N":9}`)); if e!=nil || *x.(*VA)!=(VA{9}) { panic(fmt.Sprintf("%#v %v",x,e)) }
+
+    // Decoders and the global registry work the same way:
+    dec:=r.NewDecoder(strings.NewReader(`{"Kind":"p","X":5}`))
+    e=dec.Decode(&i); if e!=nil || *i.(*VPtr)!=(VPtr{5}) { panic(fmt.Sprint(i,e)) }
+    snap:=globalRegistry.Snapshot(); defer globalRegistry.Restore(snap)
+    globalRegistry.Restore(RegistrySnapshot{})
+    AddGlobalTargetCB("jsonface.I",func(bs []byte) (interface{},error) { return &VA{},nil })
+    e=GlobalUnmarshal([]byte(`[{"N":6}]`),&is); if fmt.Sprint(is,e)!="[{6}] <nil>" { panic(fmt.Sprint(is,e)) }
+}
+
+func TestTargetCBMap(t *testing.T) {
+    target:=TargetCB(func(bs []byte) (interface{},error) {
+        kind,e:=RawValue(bs).FieldString("Kind"); if e!=nil { return nil,e }
+        switch kind {
+        case "a": return &VA{},nil
+        case "p": return &VPtr{},nil
+        case "n": return &TNest{},nil
+        default: return nil,fmt.Errorf("unknown kind: %q",kind)
+        }
+    })
+    cbs:=CBMap{}
+    cbs["jsonface.I"]=target.CB(cbs)
+
+    // Nested interfaces use the same CBMap:
+    var is []I
+    e:=Unmarshal([]byte(`[{"Kind":"a","N":1},{"Kind":"n","Kids":[{"Kind":"p","X":2}]}]`),&is,cbs)
+    if e!=nil || len(is)!=2 || is[0]!=(VA{1}) || *is[1].(TNest).Kids[0].(*VPtr)!=(VPtr{2}) { panic(fmt.Sprintf("%#v %v",is,e)) }
+    e=Unmarshal([]byte(`[{"Kind":"n","Kids":[{"Kind":"a"},{"Kind":"x"}]}]`),&is,cbs)
+    var de *DecodeError
+    if !errors.As(e,&de) || de.Path!="/0/Kids/1" || !strings.Contains(e.Error(),`unknown kind: "x"`) { panic(e) }
+}
+
+func TestTargetResultOnly(t *testing.T) {
+    // Only TargetCBs get the pointer when their value doesn't implement the interface.  Other CBs still fail:
+    var i I
+    e:=Unmarshal([]byte(`1`),&i,CBMap{ "jsonface.I":func(bs []byte) (interface{},error) { return VPtr{},nil } })
+    if e==nil || !strings.Contains(e.Error(),"cb result not assignable: jsonface.VPtr is not assignable to jsonface.I") { panic(e) }
+    vs,e:=NewVariants("Type",map[string]interface{}{ "P":VPtr{} }); if e!=nil { panic(e) }
+    e=Unmarshal([]byte(`{"Type":"P"}`),&i,VariantsMap{ "jsonface.I":vs }.CBMap()); if e==nil || !strings.Contains(e.Error(),"not assignable") { panic(e) }
+}
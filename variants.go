@@ -0,0 +1,289 @@
+// Copyright 2019 Christopher Sebastian.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package jsonface
+
+import (
+    "fmt"
+    "errors"
+    "reflect"
+    "sort"
+    "strings"
+    "encoding/json"
+)
+
+var (
+    // ErrUnknownVariant is returned (wrapped in a DecodeError) when the
+    // discriminator of a value doesn't match any of the Variants, and by
+    // Marshal() when a concrete type is not one of the Variants.
+    ErrUnknownVariant=errors.New("unknown variant")
+    // ErrMissingDiscriminator is returned (wrapped in a DecodeError) when a
+    // value doesn't contain a discriminator.
+    ErrMissingDiscriminator=errors.New("missing discriminator")
+)
+
+// TagStyle selects how the discriminator of a Variants is stored in JSON.
+type TagStyle int
+
+const (
+    // InternalTag stores the discriminator inside the value's object:
+    //     {"Type":"Bell", "BellPitch":"B♭"}
+    InternalTag TagStyle=iota
+    // AdjacentTag stores the discriminator and the value side-by-side:
+    //     {"t":"Bell", "c":{"BellPitch":"B♭"}}
+    AdjacentTag
+    // ExternalTag wraps the value in an object with the discriminator as its only key:
+    //     {"Bell":{"BellPitch":"B♭"}}
+    ExternalTag
+    // Untagged doesn't store a discriminator at all:
+    //     {"BellPitch":"B♭"}
+    // When unmarshalling, the variants are tried in order of their tags, and
+    // the first one that fits is used.  For structs, a variant only fits if it
+    // has a field for every member of the JSON object.
+    Untagged
+)
+
+func (me TagStyle) String() string {
+    switch me {
+    case InternalTag: return "InternalTag"
+    case AdjacentTag: return "AdjacentTag"
+    case ExternalTag: return "ExternalTag"
+    case Untagged: return "Untagged"
+    default: return fmt.Sprintf("TagStyle(%d)",int(me))
+    }
+}
+
+// Variants describes the concrete types that can be stored in an interface,
+// and the discriminator (tag) that identifies each of them in the JSON data.
+//
+// Most CBs follow the same pattern: read a "Type" field, switch on it, and then
+// unmarshal into the matching concrete type.  Variants builds that CB for you.
+// Nested interfaces within the chosen concrete type are also unmarshalled.
+type Variants struct {
+    style      TagStyle
+    tagKey     string
+    contentKey string
+    types      map[string]reflect.Type  // tag --> concrete type
+    tags       map[reflect.Type]string  // concrete type --> tag
+    order      []string                 // Sorted tags, for Untagged.
+}
+
+// NewVariants creates a Variants that uses the InternalTag style.  'tagKey' is
+// the name of the JSON object member that holds the discriminator, and
+// 'variants' maps each discriminator value to an example value of the
+// corresponding concrete type.  Pass a pointer (like &Piano{}) if the interface
+// should hold a pointer.  The concrete types can't have a field with the same
+// JSON name as 'tagKey', since the discriminator is stored next to the fields.
+func NewVariants(tagKey string, variants map[string]interface{}) (*Variants,error) {
+    return NewVariantsStyle(InternalTag,tagKey,"",variants)
+}
+
+// NewVariantsStyle is like NewVariants, but lets you choose the TagStyle.
+// 'tagKey' is required for InternalTag and AdjacentTag, and 'contentKey' is
+// required for AdjacentTag.  Otherwise, they must be empty.
+func NewVariantsStyle(style TagStyle, tagKey, contentKey string, variants map[string]interface{}) (*Variants,error) {
+    switch style {
+    case InternalTag:
+        if tagKey=="" { return nil,errors.New("empty tagKey") }
+        if contentKey!="" { return nil,errors.New("contentKey is only used by AdjacentTag") }
+    case AdjacentTag:
+        if tagKey=="" || contentKey=="" { return nil,errors.New("AdjacentTag needs a tagKey and a contentKey") }
+        if tagKey==contentKey { return nil,errors.New("tagKey and contentKey must be different") }
+    case ExternalTag,Untagged:
+        if tagKey!="" || contentKey!="" { return nil,fmt.Errorf("%v does not use a tagKey or contentKey",style) }
+    default: return nil,fmt.Errorf("unknown TagStyle: %v",style)
+    }
+    me:=&Variants{style:style, tagKey:tagKey, contentKey:contentKey, types:map[string]reflect.Type{}, tags:map[reflect.Type]string{}}
+    e:=me.add(variants); if e!=nil { return nil,e }
+    return me,nil
+}
+
+// With returns a copy of the Variants with more variants added.  The original
+// Variants is not modified.  It returns an error if one of the new tags or
+// concrete types is already used.
+func (me *Variants) With(variants map[string]interface{}) (*Variants,error) {
+    vs:=&Variants{style:me.style, tagKey:me.tagKey, contentKey:me.contentKey, types:make(map[string]reflect.Type,len(me.types)), tags:make(map[reflect.Type]string,len(me.tags)), order:append([]string(nil),me.order...)}
+    for k,v:=range me.types { vs.types[k]=v }
+    for k,v:=range me.tags { vs.tags[k]=v }
+    e:=vs.add(variants); if e!=nil { return nil,e }
+    return vs,nil
+}
+
+// add adds variants.  It must only be used before the Variants is shared.
+func (me *Variants) add(variants map[string]interface{}) error {
+    for _,tag:=range sortedTags(variants) {
+        x:=variants[tag]
+        if x==nil { return fmt.Errorf("nil variant for tag %q",tag) }
+        if _,has:=me.types[tag]; has { return fmt.Errorf("tag %q is already used",tag) }
+        t:=reflect.TypeOf(x)
+        if other,has:=me.tags[t]; has { return fmt.Errorf("%v is used for both %q and %q",t,other,tag) }
+        if me.style==InternalTag && me.tagKey!="" && hasField(t,me.tagKey) { return fmt.Errorf("%v has a field named %q, which is also the tagKey",t,me.tagKey) }  // It would appear twice in the output.
+        me.types[tag]=t; me.tags[t]=tag
+        me.order=append(me.order,tag)
+    }
+    sort.Strings(me.order)
+    return nil
+}
+
+func sortedTags(variants map[string]interface{}) []string {
+    tags:=make([]string,0,len(variants))
+    for tag:=range variants { tags=append(tags,tag) }
+    sort.Strings(tags)
+    return tags
+}
+
+// Style returns the TagStyle of the Variants.
+func (me *Variants) Style() TagStyle { return me.style }
+
+// CB returns a callback that unmarshals the variants.  Nested interfaces are
+// unmarshalled using 'cbs', which will usually be the CBMap that you add the
+// returned CB to:
+//
+//     cbs := jsonface.CBMap{}
+//     cbs["main.Instrument"] = instrumentVariants.CB(cbs)
+func (me *Variants) CB(cbs CBMap) CB {
+    return func(bs []byte) (interface{},error) {
+        return me.unmarshal(bs,func(bs []byte, destPtr interface{}) error { return Unmarshal(bs,destPtr,cbs) })
+    }
+}
+
+// unmarshal reads the discriminator from 'bs' and then uses 'unmarshal' to
+// decode the content into the chosen concrete type.
+func (me *Variants) unmarshal(bs []byte, unmarshal func([]byte,interface{}) error) (interface{},error) {
+    if strings.TrimSpace(string(bs))=="null" { return nil,nil }  // A nil interface, which is how Marshal() writes it.
+    var tagRaw,content RawValue
+    switch me.style {
+    case InternalTag:
+        var e error
+        tagRaw,e=RawValue(bs).Field(me.tagKey); if e!=nil { return nil,e }
+        if tagRaw==nil { return nil,fmt.Errorf("%w %q: %s",ErrMissingDiscriminator,me.tagKey,bs) }
+        content=bs
+    case AdjacentTag:
+        var e error
+        tagRaw,e=RawValue(bs).Field(me.tagKey); if e!=nil { return nil,e }
+        if tagRaw==nil { return nil,fmt.Errorf("%w %q: %s",ErrMissingDiscriminator,me.tagKey,bs) }
+        content,e=RawValue(bs).Field(me.contentKey); if e!=nil { return nil,e }
+    case ExternalTag:
+        var m map[string]json.RawMessage
+        e:=json.Unmarshal(bs,&m); if e!=nil || len(m)!=1 { return nil,fmt.Errorf("%w: expected an object with exactly one member: %s",ErrMissingDiscriminator,bs) }
+        for tag,raw:=range m { tagRaw,_=json.Marshal(tag); content=RawValue(raw) }
+    case Untagged:
+        for _,tag:=range me.order {
+            t:=me.types[tag]
+            if !fitsKeys(bs,t) { continue }
+            x,e:=newVariant(t,bs,unmarshal); if e==nil { return x,nil }
+        }
+        return nil,fmt.Errorf("%w: no variant matches: %s",ErrUnknownVariant,bs)
+    }
+    var tag string
+    json.Unmarshal(tagRaw,&tag)  // A non-string discriminator is treated as an unknown variant.
+    t,has:=me.types[tag]; if !has { return nil,fmt.Errorf("%w %s: %s",ErrUnknownVariant,tagRaw,bs) }
+    return newVariant(t,content,unmarshal)
+}
+
+// newVariant creates a value of type 't' and unmarshals 'content' into it.  If
+// 'content' is nil (an AdjacentTag value without content), the zero value is used.
+func newVariant(t reflect.Type, content []byte, unmarshal func([]byte,interface{}) error) (interface{},error) {
+    if t.Kind()==reflect.Ptr {
+        ptr:=reflect.New(t.Elem())
+        if content!=nil { e:=unmarshal(content,ptr.Interface()); if e!=nil { return nil,e } }
+        return ptr.Interface(),nil
+    }
+    ptr:=reflect.New(t)
+    if content!=nil { e:=unmarshal(content,ptr.Interface()); if e!=nil { return nil,e } }
+    return ptr.Elem().Interface(),nil
+}
+
+// hasField reports whether the struct type 't' (or the struct that 't' points
+// to) has a field with the JSON name 'name'.
+func hasField(t reflect.Type, name string) bool {
+    if t.Kind()==reflect.Ptr { t=t.Elem() }
+    if t.Kind()!=reflect.Struct { return false }
+    for _,f:=range jsonFields(t) {
+        if f.name==name { return true }
+    }
+    return false
+}
+
+// fitsKeys reports whether every member of the JSON object 'bs' has a matching
+// field in the struct type 't'.  It is used to choose Untagged variants, since
+// encoding/json would otherwise happily ignore members that don't belong.
+func fitsKeys(bs []byte, t reflect.Type) bool {
+    if t.Kind()==reflect.Ptr { t=t.Elem() }
+    if t.Kind()!=reflect.Struct { return true }
+    var m map[string]json.RawMessage
+    if json.Unmarshal(bs,&m)!=nil { return true }  // Not an object.  Let unmarshal decide.
+    fields:=jsonFields(t)
+    for k:=range m {
+        found:=false
+        for _,f:=range fields {
+            if strings.EqualFold(f.name,k) { found=true; break }
+        }
+        if !found { return false }
+    }
+    return true
+}
+
+// VariantsMap is a TypeName-->*Variants mapping, like CBMap.  It is used by
+// Marshal() to find the discriminators for interface values.
+type VariantsMap map[TypeName]*Variants
+
+// CBMap returns a CBMap that contains a CB for each of the Variants.  Nested
+// interfaces are unmarshalled with the returned CBMap, so you can use the same
+// VariantsMap for both Marshal() and Unmarshal():
+//
+//     bs,err := jsonface.Marshal(x, vm)
+//     err = jsonface.Unmarshal(bs, &x, vm.CBMap())
+func (me VariantsMap) CBMap() CBMap {
+    cbs:=make(CBMap,len(me))
+    for name,vs:=range me { cbs[name]=vs.CB(cbs) }
+    return cbs
+}
+
+// RegisterVariantsStyle is like RegisterVariants, but lets you choose the
+// TagStyle.  See NewVariantsStyle() for details.
+func RegisterVariantsStyle(name TypeName, style TagStyle, tagKey, contentKey string, variants map[string]interface{}) {
+    vs,e:=NewVariantsStyle(style,tagKey,contentKey,variants); if e!=nil { panic(e) }
+    registerGlobalVariants(name,vs)
+}
+
+// RegisterVariants creates a Variants and adds its CB to the global callback
+// registry, like AddGlobalCB().  Nested interfaces are unmarshalled with
+// GlobalUnmarshal().  The Variants are also used by GlobalMarshal().  It panics
+// if the variants are invalid, or if a CB is already defined for 'name'.
+//
+// Example:
+//
+//     jsonface.RegisterVariants("main.Instrument", "Type", map[string]interface{}{
+//         "Bell": Bell{},
+//         "Drum": Drum{},
+//     })
+func RegisterVariants(name TypeName, tagKey string, variants map[string]interface{}) {
+    vs,e:=NewVariants(tagKey,variants); if e!=nil { panic(e) }
+    registerGlobalVariants(name,vs)
+}
+
+// AddGlobalVariants adds more variants to the Variants that were registered
+// for 'name' with RegisterVariants().  This lets several packages contribute
+// implementations of the same interface:  one package registers the Variants
+// (possibly with no variants at all), which chooses the TagStyle and tagKey,
+// and each plugin package adds its own from its init() function.  The order
+// doesn't matter; if the Variants aren't registered yet, the plugins'
+// variants are held until they are.  It panics if a tag is already used.  See
+// Registry.AddVariants() for details.
+//
+// Example:
+//
+//     func init() {
+//         jsonface.AddGlobalVariants("pipeline.Step", map[string]interface{}{
+//             "resize": Resize{},
+//         })
+//     }
+func AddGlobalVariants(name TypeName, variants map[string]interface{}) {
+    e:=globalRegistry.AddVariants(name,variants); if e!=nil { panic(e) }
+}
+
+func registerGlobalVariants(name TypeName, vs *Variants) {
+    e:=globalRegistry.RegisterVariants(name,vs); if e!=nil { panic(e) }
+}
@@ -0,0 +1,114 @@
+package jsonface
+
+import (
+    "testing"
+    "fmt"
+    "strings"
+)
+
+type (
+    VA   struct { N int }
+    VB   struct { S string; Kid I }
+    VPtr struct { X float64 }
+)
+func (me VA) F() {}
+func (me VB) F() {}
+func (me *VPtr) F() {}
+
+func TestVariants(t *testing.T) {
+    vs,e:=NewVariants("Type",map[string]interface{}{ "A":VA{}, "B":VB{}, "P":&VPtr{} }); if e!=nil { panic(e) }
+    vcbs:=CBMap{}
+    vcbs["jsonface.I"]=vs.CB(vcbs)
+
+    var is []I
+    e=Unmarshal([]byte(`[{"Type":"A","N":1}, {"Type":"B","S":"s","Kid":{"Type":"B","Kid":{"N":2,"Type":"A"}}}, {"Type":"P","X":1.5}]`),&is,vcbs)
+    if e!=nil || len(is)!=3 { panic(fmt.Sprint(is,e)) }
+    if fmt.Sprintf("%#v",is[:2])!=`[]jsonface.I{jsonface.VA{N:1}, jsonface.VB{S:"s", Kid:jsonface.VB{S:"", Kid:jsonface.VA{N:2}}}}` { panic(fmt.Sprintf("%#v",is)) }
+    if p,ok:=is[2].(*VPtr); !ok || p.X!=1.5 { panic(fmt.Sprintf("%#v",is[2])) }
+
+    e=Unmarshal([]byte(`[{"Type":"C"}]`),&is,vcbs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "/0": unknown variant "C": {"Type":"C"}` { panic(e) }
+    e=Unmarshal([]byte(`[{"Type":1}]`),&is,vcbs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "/0": unknown variant 1: {"Type":1}` { panic(e) }
+    e=Unmarshal([]byte(`[{"N":1}]`),&is,vcbs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "/0": missing discriminator "Type": {"N":1}` { panic(e) }
+
+    _,e=NewVariants("",nil); if fmt.Sprint(e)!="empty tagKey" { panic(e) }
+    _,e=NewVariants("Type",map[string]interface{}{ "A":nil }); if fmt.Sprint(e)!=`nil variant for tag "A"` { panic(e) }
+    _,e=NewVariants("Type",map[string]interface{}{ "A":VA{}, "AA":VA{} }); if e==nil || !strings.Contains(e.Error(),"jsonface.VA is used for both") { panic(e) }
+    _,e=NewVariants("N",map[string]interface{}{ "A":VA{} }); if fmt.Sprint(e)!=`jsonface.VA has a field named "N", which is also the tagKey` { panic(e) }
+    _,e=NewVariants("S",map[string]interface{}{ "B":&VB{} }); if fmt.Sprint(e)!=`*jsonface.VB has a field named "S", which is also the tagKey` { panic(e) }
+    vs,_=NewVariants("S",map[string]interface{}{ "A":VA{} })
+    _,e=vs.With(map[string]interface{}{ "B":VB{} }); if e==nil { panic("expected error") }
+    _,e=NewVariantsStyle(AdjacentTag,"N","c",map[string]interface{}{ "A":VA{} }); if e!=nil { panic(e) }  // Only InternalTag puts the discriminator inside the value.
+}
+
+func TestVariantStyles(t *testing.T) {
+    variants:=map[string]interface{}{ "A":VA{}, "B":VB{}, "P":&VPtr{} }
+    in:=[]I{ VA{1}, VB{"s",VA{2}}, &VPtr{3.5} }
+    for _,test:=range []struct {
+        style           TagStyle
+        tagKey,contentKey string
+        want            string
+    }{
+        {InternalTag,"t","",`[{"t":"A","N":1},{"t":"B","S":"s","Kid":{"t":"A","N":2}},{"t":"P","X":3.5}]`},
+        {AdjacentTag,"t","c",`[{"t":"A","c":{"N":1}},{"t":"B","c":{"S":"s","Kid":{"t":"A","c":{"N":2}}}},{"t":"P","c":{"X":3.5}}]`},
+        {ExternalTag,"","",`[{"A":{"N":1}},{"B":{"S":"s","Kid":{"A":{"N":2}}}},{"P":{"X":3.5}}]`},
+        {Untagged,"","",`[{"N":1},{"S":"s","Kid":{"N":2}},{"X":3.5}]`},
+    } {
+        vs,e:=NewVariantsStyle(test.style,test.tagKey,test.contentKey,variants); if e!=nil { panic(e) }
+        vm:=VariantsMap{ "jsonface.I":vs }
+        bs,e:=Marshal(in,vm); if string(bs)!=test.want || e!=nil { panic(fmt.Sprintf("%v: %s %v",test.style,bs,e)) }
+        var out []I
+        e=Unmarshal(bs,&out,vm.CBMap()); if e!=nil { panic(fmt.Sprint(test.style,e)) }
+        if fmt.Sprintf("%#v %#v %v",out[0],out[1],*out[2].(*VPtr))!=`jsonface.VA{N:1} jsonface.VB{S:"s", Kid:jsonface.VA{N:2}} {3.5}` { panic(fmt.Sprintf("%v: %#v",test.style,out)) }
+    }
+
+    vs,_:=NewVariantsStyle(AdjacentTag,"t","c",variants); acbs:=VariantsMap{ "jsonface.I":vs }.CBMap()
+    var i I
+    e:=Unmarshal([]byte(`{"t":"A"}`),&i,acbs); if fmt.Sprintf("%#v %v",i,e)!=`jsonface.VA{N:0} <nil>` { panic(fmt.Sprint(i,e)) }  // Missing content means the zero value.
+    vs,_=NewVariantsStyle(ExternalTag,"","",variants); ecbs:=VariantsMap{ "jsonface.I":vs }.CBMap()
+    e=Unmarshal([]byte(`{"A":{},"B":{}}`),&i,ecbs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "": missing discriminator: expected an object with exactly one member: {"A":{},"B":{}}` { panic(e) }
+    e=Unmarshal([]byte(`{"C":{}}`),&i,ecbs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "": unknown variant "C": {"C":{}}` { panic(e) }
+    vs,_=NewVariantsStyle(Untagged,"","",variants); ucbs:=VariantsMap{ "jsonface.I":vs }.CBMap()
+    e=Unmarshal([]byte(`{"Z":1}`),&i,ucbs); if fmt.Sprint(e)!=`jsonface: cannot unmarshal jsonface.I at "": unknown variant: no variant matches: {"Z":1}` { panic(e) }
+
+    _,e=NewVariantsStyle(InternalTag,"t","c",variants); if fmt.Sprint(e)!="contentKey is only used by AdjacentTag" { panic(e) }
+    _,e=NewVariantsStyle(AdjacentTag,"t","",variants); if fmt.Sprint(e)!="AdjacentTag needs a tagKey and a contentKey" { panic(e) }
+    _,e=NewVariantsStyle(AdjacentTag,"t","t",variants); if fmt.Sprint(e)!="tagKey and contentKey must be different" { panic(e) }
+    _,e=NewVariantsStyle(ExternalTag,"t","",variants); if fmt.Sprint(e)!="ExternalTag does not use a tagKey or contentKey" { panic(e) }
+    _,e=NewVariantsStyle(TagStyle(9),"","",variants); if fmt.Sprint(e)!="unknown TagStyle: TagStyle(9)" { panic(e) }
+}
+
+type VHolder struct { A I; B VB; L []I }
+
+func TestVariantsNull(t *testing.T) {
+    variants:=map[string]interface{}{ "A":VA{}, "B":VB{} }
+    for _,test:=range []struct{ style TagStyle; tagKey,contentKey string }{
+        {InternalTag,"Type",""},
+        {AdjacentTag,"t","c"},
+        {ExternalTag,"",""},
+        {Untagged,"",""},  // Without the special case, null would "fit" every struct variant.
+    } {
+        vs,e:=NewVariantsStyle(test.style,test.tagKey,test.contentKey,variants); if e!=nil { panic(e) }
+        vm:=VariantsMap{ "jsonface.I":vs }
+
+        // Nil interfaces are marshalled as null, so null must unmarshal to a nil interface:
+        in:=VHolder{L:[]I{VA{1},nil}}
+        bs,e:=Marshal(in,vm); if e!=nil || !strings.Contains(string(bs),`{"A":null,`) { panic(fmt.Sprintf("%s %v",bs,e)) }
+        out:=VHolder{A:VA{9}}
+        e=Unmarshal(bs,&out,vm.CBMap()); if e!=nil { panic(fmt.Sprint(test.style,e)) }
+        if fmt.Sprintf("%#v",out)!=fmt.Sprintf("%#v",in) { panic(fmt.Sprintf("%v: %#v",test.style,out)) }
+        x,e:=vs.CB(vm.CBMap())([]byte(" null ")); if x!=nil || e!=nil { panic(fmt.Sprint(x,e)) }
+    }
+}
+
+func TestVariantsWith(t *testing.T) {
+    vs,e:=NewVariants("Type",map[string]interface{}{ "A":VA{} }); if e!=nil { panic(e) }
+    vs2,e:=vs.With(map[string]interface{}{ "B":VB{}, "P":&VPtr{} }); if e!=nil { panic(e) }
+    if fmt.Sprint(vs.order,vs2.order)!="[A] [A B P]" { panic(fmt.Sprint(vs.order,vs2.order)) }
+    var i I
+    e=Unmarshal([]byte(`{"Type":"B","Kid":{"Type":"A","N":1}}`),&i,VariantsMap{ "jsonface.I":vs2 }.CBMap()); if fmt.Sprint(i,e)!="{ {1}} <nil>" { panic(fmt.Sprint(i,e)) }
+    e=Unmarshal([]byte(`{"Type":"B"}`),&i,VariantsMap{ "jsonface.I":vs }.CBMap()); if e==nil { panic("original Variants was modified") }
+
+    _,e=vs2.With(map[string]interface{}{ "A":VA{} }); if fmt.Sprint(e)!=`tag "A" is already used` { panic(e) }
+    _,e=vs2.With(map[string]interface{}{ "A2":VA{} }); if fmt.Sprint(e)!=`jsonface.VA is used for both "A" and "A2"` { panic(e) }
+    _,e=vs2.With(map[string]interface{}{ "N":nil }); if fmt.Sprint(e)!=`nil variant for tag "N"` { panic(e) }
+}